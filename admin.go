@@ -0,0 +1,238 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrNotAdmin is returned when a user outside Config.Admins reaches the
+// admin console
+var ErrNotAdmin = errors.New("not an admin")
+
+const (
+	// defaultAuditLimit and maxAuditLimit bound the audit events listed at
+	// once
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// adminFunc serves an admin request on behalf of the admin with a login
+type adminFunc func(r *http.Request, token, login string) (*envelope, error)
+
+// adminRoute describes a route of the admin console. Those changing data
+// are listed in auditedRoutes.
+type adminRoute struct {
+	method string
+	path   string
+	status int
+	handle adminFunc
+}
+
+func (h *Handler) adminRoutes() []*adminRoute {
+	return []*adminRoute{
+		{method: "GET", path: "/users", handle: h.adminListUsers},
+		{method: "DELETE", path: "/users/{key}", status: http.StatusNoContent, handle: h.adminDeleteUser},
+		{method: "GET", path: "/stats", handle: h.adminGetStats},
+		{method: "POST", path: "/repositories/{owner}/{name}/sync", status: http.StatusAccepted, handle: h.adminSyncRepository},
+		{method: "GET", path: "/jobs", handle: h.adminListJobs},
+		{method: "POST", path: "/jobs/{id}/requeue", status: http.StatusAccepted, handle: h.adminRequeueJob},
+		{method: "GET", path: "/audit", handle: h.adminListAudit},
+		{method: "POST", path: "/reindex", status: http.StatusAccepted, handle: h.adminReindex},
+	}
+}
+
+// registerAdmin adds the admin console to a router
+func (h *Handler) registerAdmin(r *mux.Router) {
+	r.HandleFunc("/admin", h.getAdminHandler).
+		Methods("GET")
+	admin := r.PathPrefix("/admin").Subrouter()
+	for _, route := range h.adminRoutes() {
+		admin.HandleFunc(route.path, h.serveAdmin(route)).
+			Methods(route.method)
+	}
+}
+
+func (h *Handler) getAdminHandler(w http.ResponseWriter, r *http.Request) {
+	token := currentUser(r)
+	if token == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if _, err := h.requireAdmin(r.Context(), token); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.templates.ExecuteTemplate(w, "admin.html", nil)
+}
+
+// serveAdmin checks a request comes from an admin and writes the envelope
+// returned by the route
+func (h *Handler) serveAdmin(route *adminRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token := currentUser(r)
+		if token == "" {
+			writeError(w, r, ErrNoSession)
+			return
+		}
+		login, err := h.requireAdmin(ctx, token)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		env, err := route.handle(r, token, login)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(env)
+	}
+}
+
+// requireAdmin returns the Github login of a user if it is allow-listed
+func (h *Handler) requireAdmin(ctx context.Context, token string) (string, error) {
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	for _, admin := range h.admins {
+		if strings.EqualFold(admin, login) {
+			return login, nil
+		}
+	}
+	return "", ErrNotAdmin
+}
+
+func (h *Handler) adminListUsers(r *http.Request, token, login string) (*envelope, error) {
+	users, err := h.store.GetUsers(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	return apiList(users, len(users)), nil
+}
+
+func (h *Handler) adminDeleteUser(r *http.Request, token, login string) (*envelope, error) {
+	key := mux.Vars(r)["key"]
+	if err := h.store.DeleteUser(r.Context(), key); err != nil {
+		return nil, err
+	}
+	h.client.forget(key)
+	return nil, nil
+}
+
+func (h *Handler) adminGetStats(r *http.Request, token, login string) (*envelope, error) {
+	stats, err := h.store.GetStats(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	return apiData(stats), nil
+}
+
+// adminSyncRepository queues a job fetching an indexed repository again.
+// It runs with the admin's token, which must be able to read the
+// repository.
+func (h *Handler) adminSyncRepository(r *http.Request, token, login string) (*envelope, error) {
+	ctx := r.Context()
+	args := mux.Vars(r)
+	owner, name := args["owner"], args["name"]
+	fullName := owner + "/" + name
+	if !h.store.RepoExists(ctx, fullName) {
+		return nil, ErrRepoNotFound
+	}
+	job, err := h.jobs.Enqueue(login, JobSync, fullName, func(ctx context.Context) error {
+		return h.syncRepository(ctx, token, owner, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apiData(job), nil
+}
+
+// adminReindex queues a job moving every index to the current schema.
+// Commits that have to be fetched again are fetched with the admin's
+// token, repositories it cannot read are left for their next sync.
+func (h *Handler) adminReindex(r *http.Request, token, login string) (*envelope, error) {
+	fetch := func(ctx context.Context, repo *Repository) ([]*GitCommit, error) {
+		return h.fetchCommits(ctx, token, repo.Owner.Username, repo.Name)
+	}
+	job, err := h.jobs.Enqueue(login, JobReindex, "", func(ctx context.Context) error {
+		return h.store.Reindex(ctx, fetch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apiData(job), nil
+}
+
+// adminListJobs lists the jobs of every user, newest first, keeping those
+// in the state given by the state parameter
+func (h *Handler) adminListJobs(r *http.Request, token, login string) (*envelope, error) {
+	state := r.URL.Query().Get("state")
+	jobs := []Job{}
+	for _, job := range h.jobs.List("") {
+		if state == "" || job.State == state {
+			jobs = append(jobs, job)
+		}
+	}
+	return apiList(jobs, len(jobs)), nil
+}
+
+func (h *Handler) adminRequeueJob(r *http.Request, token, login string) (*envelope, error) {
+	job, err := h.jobs.Requeue(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, err
+	}
+	return apiData(job), nil
+}
+
+// adminListAudit lists the latest audit events, filtered by the login,
+// action and target parameters and by since and until, RFC 3339 times
+func (h *Handler) adminListAudit(r *http.Request, token, login string) (*envelope, error) {
+	params := r.URL.Query()
+	q := &AuditQuery{
+		Login:  params.Get("login"),
+		Action: params.Get("action"),
+		Target: params.Get("target"),
+		Limit:  defaultAuditLimit,
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, ErrBadRequest
+		}
+		q.Limit = min(n, maxAuditLimit)
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, ErrBadRequest
+			}
+			*t = parsed
+		}
+	}
+	events, err := h.store.GetAuditEvents(r.Context(), q)
+	if err != nil {
+		return nil, err
+	}
+	return apiList(events, len(events)), nil
+}
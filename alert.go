@@ -0,0 +1,190 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrWebhookAddress is returned when a webhook points at an address of the
+// server's own network, such as loopback, private or link-local addresses
+var ErrWebhookAddress = errors.New("webhook address not allowed")
+
+const (
+	// webhookTimeout bounds the delivery of an alert to a webhook
+	webhookTimeout = 10 * time.Second
+
+	// smtpTimeout bounds the delivery of an alert by email, from dialing
+	// the SMTP server to the end of the conversation
+	smtpTimeout = 30 * time.Second
+)
+
+// SMTPConfig holds the outgoing mail server used for alerts
+type SMTPConfig struct {
+	// Addr is the host:port of the server, alerts are not emailed without it
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Notifier delivers the alerts of saved searches to webhooks and by email
+type Notifier struct {
+	smtp   SMTPConfig
+	client *http.Client
+}
+
+// NewNotifier creates a new notifier sending email through config. Webhooks
+// are only posted to public addresses, checked as each connection is dialed
+// so names resolving to internal addresses and redirects to them are
+// refused too.
+func NewNotifier(config SMTPConfig) *Notifier {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil || !isPublicAddr(addr.Addr()) {
+				return ErrWebhookAddress
+			}
+			return nil
+		},
+	}
+	return &Notifier{
+		smtp: config,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: webhookTimeout,
+			},
+		},
+	}
+}
+
+// isPublicAddr reports whether an address may be reached by webhooks
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// Notify delivers an alert to every destination of its saved search
+func (n *Notifier) Notify(ctx context.Context, alert *Alert) error {
+	if alert.Search.Webhook != "" {
+		if err := n.postWebhook(ctx, alert); err != nil {
+			return err
+		}
+	}
+	if alert.Search.Email != "" {
+		if err := n.sendEmail(ctx, alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postWebhook posts an alert as JSON
+func (n *Notifier) postWebhook(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", alert.Search.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered with status %d", alert.Search.Webhook, resp.StatusCode)
+	}
+	return nil
+}
+
+// sendEmail mails a plain text summary of an alert. The conversation with
+// the SMTP server ends after smtpTimeout, or as soon as ctx is done.
+func (n *Notifier) sendEmail(ctx context.Context, alert *Alert) error {
+	if n.smtp.Addr == "" {
+		return fmt.Errorf("no SMTP server configured for saved search %s", alert.Search.ID)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.smtp.From)
+	fmt.Fprintf(&body, "To: %s\r\n", alert.Search.Email)
+	fmt.Fprintf(&body, "Subject: %s: %d new commits in %s\r\n\r\n", alert.Search.Name, len(alert.Commits), alert.Search.Repository)
+	for _, commit := range alert.Commits {
+		subject := strings.SplitN(commit.Message, "\n", 2)[0]
+		fmt.Fprintf(&body, "%.7s %s\r\n%s\r\n\r\n", commit.SHA, subject, commit.URL)
+	}
+
+	// Dial the server, closing the connection when ctx is done
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", n.smtp.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	host, _, err := net.SplitHostPort(n.smtp.Addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	// Send the message as smtp.SendMail would
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.smtp.Username != "" {
+		auth := smtp.PlainAuth("", n.smtp.Username, n.smtp.Password, host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.smtp.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(alert.Search.Email); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(body.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
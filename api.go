@@ -0,0 +1,403 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is the path every route of version 1 of the API is served under
+const apiPrefix = "/api/v1"
+
+// Job kinds
+const (
+	JobActivate = "activate"
+	JobSync     = "sync"
+	JobReindex  = "reindex"
+)
+
+// envelope wraps the data of every successful API response
+type envelope struct {
+	Data interface{} `json:"data"`
+	Meta *Meta       `json:"meta,omitempty"`
+}
+
+// Meta describes the list in a response envelope
+type Meta struct {
+	Count int `json:"count"`
+}
+
+// apiFunc serves an API request of an authenticated user
+type apiFunc func(r *http.Request, token string) (*envelope, error)
+
+// apiRoute describes an API route. The route table is used both to register
+// the routes and to generate the OpenAPI document, so the two cannot drift
+// apart.
+type apiRoute struct {
+	method  string
+	path    string
+	summary string
+	query   []apiParam
+
+	// request and response are zero values of the types sent and received,
+	// list marks responses holding a list of response
+	request  interface{}
+	response interface{}
+	list     bool
+	status   int
+
+	handle apiFunc
+}
+
+type apiParam struct {
+	name        string
+	description string
+}
+
+// searchParams are the query parameters of commit searches
+var searchParams = []apiParam{
+	{"q", "terms matched against commit messages and pull request titles"},
+	{"branch", "only commits contained in this branch"},
+	{"tag", "only commits contained in this tag"},
+}
+
+func (h *Handler) apiRoutes() []*apiRoute {
+	return []*apiRoute{
+		{
+			method: "GET", path: "/repositories", summary: "List active repositories, or suggest repositories starting with q",
+			query:    []apiParam{{"q", "prefix of a repository name or full name"}},
+			response: &Repository{}, list: true, handle: h.apiListRepositories,
+		},
+		{
+			method: "GET", path: "/repositories/{owner}/{name}", summary: "Get a repository from the repository list",
+			response: &Repository{}, handle: h.apiGetRepository,
+		},
+		{
+			method: "POST", path: "/repositories/{owner}/{name}/activation", summary: "Queue a job indexing and activating a repository",
+			response: &Job{}, status: http.StatusAccepted, handle: h.apiActivateRepository,
+		},
+		{
+			method: "DELETE", path: "/repositories/{owner}/{name}/activation", summary: "Deactivate a repository, keeping its commits indexed",
+			status: http.StatusNoContent, handle: h.apiDeactivateRepository,
+		},
+		{
+			method: "POST", path: "/repositories/{owner}/{name}/sync", summary: "Queue a job fetching the commits and pull requests of a repository again",
+			response: &Job{}, status: http.StatusAccepted, handle: h.apiSyncRepository,
+		},
+		{
+			method: "GET", path: "/repositories/{owner}/{name}/commits", summary: "Search the commits of a repository",
+			query:    searchParams,
+			response: &IndexCommit{}, list: true, handle: h.apiListCommits,
+		},
+		{
+			method: "GET", path: "/repositories/{owner}/{name}/commits/{sha}", summary: "Get the details and diff of a commit",
+			response: &CommitDetail{}, handle: h.apiGetCommit,
+		},
+		{
+			method: "GET", path: "/repositories/{owner}/{name}/search", summary: "Search commits, pull requests and review comments",
+			query:    append([]apiParam{{"type", "commit, pull_request or review_comment"}}, searchParams...),
+			response: &searchResponse{}, handle: h.apiSearch,
+		},
+		{
+			method: "GET", path: "/jobs", summary: "List the user's jobs, newest first",
+			response: &Job{}, list: true, handle: h.apiListJobs,
+		},
+		{
+			method: "GET", path: "/jobs/{id}", summary: "Get a job",
+			response: &Job{}, handle: h.apiGetJob,
+		},
+		{
+			method: "GET", path: "/searches", summary: "List the user's saved searches",
+			response: &SavedSearch{}, list: true, handle: h.apiListSearches,
+		},
+		{
+			method: "POST", path: "/searches", summary: "Save a search alerting a webhook or an email address",
+			request: &SavedSearch{}, response: &SavedSearch{}, status: http.StatusCreated, handle: h.apiCreateSearch,
+		},
+		{
+			method: "DELETE", path: "/searches/{id}", summary: "Delete a saved search",
+			status: http.StatusNoContent, handle: h.apiDeleteSearch,
+		},
+	}
+}
+
+// registerAPI adds the API routes and the OpenAPI document to a router
+func (h *Handler) registerAPI(r *mux.Router) {
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	for _, route := range h.apiRoutes() {
+		api.HandleFunc(route.path, h.serveAPI(route)).
+			Methods(route.method)
+	}
+	api.HandleFunc("/openapi.json", h.getOpenAPIHandler).
+		Methods("GET")
+}
+
+// serveAPI authenticates a request and writes the envelope returned by the
+// route, or an error
+func (h *Handler) serveAPI(route *apiRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentUser(r)
+		if token == "" {
+			writeError(w, r, ErrNoSession)
+			return
+		}
+
+		env, err := route.handle(r, token)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(env)
+	}
+}
+
+func (h *Handler) getOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPI(h.apiRoutes(), h.domain+apiPrefix))
+}
+
+func apiData(v interface{}) *envelope {
+	return &envelope{Data: v}
+}
+
+func apiList(v interface{}, count int) *envelope {
+	return &envelope{Data: v, Meta: &Meta{Count: count}}
+}
+
+func (h *Handler) apiListRepositories(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	repos, err := h.readableRepositories(ctx, token, r.URL.Query().Get("q"))
+	if err != nil {
+		return nil, err
+	}
+	return apiList(repos, len(repos)), nil
+}
+
+func (h *Handler) apiGetRepository(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	repo, err := h.store.GetRepository(ctx, token, repositoryName(r))
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkAccess(ctx, token, repo); err != nil {
+		return nil, err
+	}
+	return apiData(repo), nil
+}
+
+func (h *Handler) apiActivateRepository(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	args := mux.Vars(r)
+	owner, name := args["owner"], args["name"]
+	fullName := owner + "/" + name
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		return nil, err
+	}
+	job, err := h.enqueue(ctx, token, JobActivate, fullName, func(ctx context.Context) error {
+		if err := h.indexRepository(ctx, token, owner, name); err != nil {
+			return err
+		}
+		return h.store.ActivateRepository(ctx, token, fullName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apiData(job), nil
+}
+
+func (h *Handler) apiDeactivateRepository(r *http.Request, token string) (*envelope, error) {
+	if err := h.store.DeactivateRepository(r.Context(), token, repositoryName(r)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (h *Handler) apiSyncRepository(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	args := mux.Vars(r)
+	owner, name := args["owner"], args["name"]
+	fullName := owner + "/" + name
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		return nil, err
+	}
+	job, err := h.enqueue(ctx, token, JobSync, fullName, func(ctx context.Context) error {
+		return h.syncRepository(ctx, token, owner, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apiData(job), nil
+}
+
+func (h *Handler) apiListCommits(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	fullName := repositoryName(r)
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		return nil, err
+	}
+	commits, err := h.store.GetCommits(ctx, fullName, apiSearchQuery(r))
+	if err != nil {
+		return nil, err
+	}
+	if commits == nil {
+		commits = []*IndexCommit{}
+	}
+	return apiList(commits, len(commits)), nil
+}
+
+func (h *Handler) apiGetCommit(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	args := mux.Vars(r)
+	owner, name, sha := args["owner"], args["name"], args["sha"]
+	if !shaPattern.MatchString(sha) {
+		return nil, ErrBadRequest
+	}
+	if err := h.authorize(ctx, token, owner+"/"+name); err != nil {
+		return nil, err
+	}
+	detail, err := h.commitDetail(ctx, token, owner, name, sha)
+	if err != nil {
+		return nil, err
+	}
+	return apiData(detail), nil
+}
+
+func (h *Handler) apiSearch(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	fullName := repositoryName(r)
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		return nil, err
+	}
+	query := apiSearchQuery(r)
+	query.Type = r.URL.Query().Get("type")
+	resp, err := h.search(ctx, fullName, query)
+	if err != nil {
+		return nil, err
+	}
+	return apiData(resp), nil
+}
+
+func (h *Handler) apiListJobs(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	jobs := h.jobs.List(login)
+	return apiList(jobs, len(jobs)), nil
+}
+
+func (h *Handler) apiGetJob(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	job, ok := h.jobs.Get(mux.Vars(r)["id"])
+	if !ok || job.Owner != login {
+		return nil, ErrJobNotFound
+	}
+	return apiData(job), nil
+}
+
+func (h *Handler) apiListSearches(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	searches, err := h.store.GetSearches(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	if searches == nil {
+		searches = []*SavedSearch{}
+	}
+	return apiList(searches, len(searches)), nil
+}
+
+func (h *Handler) apiCreateSearch(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	var ss SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&ss); err != nil {
+		return nil, ErrBadRequest
+	}
+	if err := h.saveSearch(ctx, token, &ss); err != nil {
+		return nil, err
+	}
+	return apiData(&ss), nil
+}
+
+func (h *Handler) apiDeleteSearch(r *http.Request, token string) (*envelope, error) {
+	ctx := r.Context()
+	if err := h.deleteSearch(ctx, token, mux.Vars(r)["id"]); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// readableRepositories lists the active repositories of a user, or
+// suggests repositories starting with search, leaving out private
+// repositories the user can no longer read
+func (h *Handler) readableRepositories(ctx context.Context, token, search string) ([]*Repository, error) {
+	var repos []*Repository
+	var err error
+	if search != "" {
+		repos, err = h.store.GetRepositories(ctx, token, search)
+	} else {
+		repos, err = h.store.GetActiveRepositories(ctx, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	readable := []*Repository{}
+	for _, repo := range repos {
+		if err := h.checkAccess(ctx, token, repo); errors.Is(err, ErrRepoNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		readable = append(readable, repo)
+	}
+	return readable, nil
+}
+
+// enqueue queues a job on behalf of the user
+func (h *Handler) enqueue(ctx context.Context, token, kind, fullName string, run func(ctx context.Context) error) (Job, error) {
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return Job{}, err
+	}
+	return h.jobs.Enqueue(login, kind, fullName, run)
+}
+
+// repositoryName reads the full name of a repository from API route vars
+func repositoryName(r *http.Request) string {
+	args := mux.Vars(r)
+	return args["owner"] + "/" + args["name"]
+}
+
+// apiSearchQuery reads the search parameters of an API request
+func apiSearchQuery(r *http.Request) *SearchQuery {
+	params := r.URL.Query()
+	return &SearchQuery{
+		Term:   params.Get("q"),
+		Branch: params.Get("branch"),
+		Tag:    params.Get("tag"),
+	}
+}
@@ -0,0 +1,164 @@
+package search
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditLogin      = "login"
+	AuditLogout     = "logout"
+	AuditActivate   = "activate"
+	AuditDeactivate = "deactivate"
+	AuditSearch     = "search"
+	AuditExport     = "export"
+	AuditGraphQL    = "graphql"
+	AuditDeleteUser = "delete_user"
+	AuditSync       = "sync_repository"
+	AuditRequeue    = "requeue_job"
+	AuditReindex    = "reindex"
+)
+
+// Outcomes of audited requests, told apart by their status
+const (
+	AuditSucceeded = "succeeded"
+	AuditFailed    = "failed"
+)
+
+// auditedRoutes maps the method and path template of audited routes to
+// their action
+var auditedRoutes = map[string]string{
+	// Sessions
+	"GET /login/callback": AuditLogin,
+	"DELETE /logout":      AuditLogout,
+
+	// Repositories
+	"POST /repositories/activate":                                     AuditActivate,
+	"POST " + apiPrefix + "/repositories/{owner}/{name}/activation":   AuditActivate,
+	"POST /repositories/deactivate":                                   AuditDeactivate,
+	"DELETE " + apiPrefix + "/repositories/{owner}/{name}/activation": AuditDeactivate,
+
+	// Searches, which turn into exports when a format is asked for
+	"GET /dashboard/{owner}/{repository}/commits":               AuditSearch,
+	"GET /dashboard/{owner}/{repository}/search":                AuditSearch,
+	"GET " + apiPrefix + "/repositories/{owner}/{name}/commits": AuditSearch,
+	"GET " + apiPrefix + "/repositories/{owner}/{name}/search":  AuditSearch,
+
+	// GraphQL queries, recorded with their document
+	"GET /graphql":  AuditGraphQL,
+	"POST /graphql": AuditGraphQL,
+
+	// Admin actions
+	"DELETE /admin/users/{key}":                    AuditDeleteUser,
+	"POST /admin/repositories/{owner}/{name}/sync": AuditSync,
+	"POST /admin/jobs/{id}/requeue":                AuditRequeue,
+	"POST /admin/reindex":                          AuditReindex,
+}
+
+type auditKey struct{}
+
+// auditRequests records the audited routes in the append-only audit log,
+// with the user, their address and the outcome of the request. Handlers
+// add what only they know, such as the login of a user signing in, to the
+// event returned by auditEvent.
+func (h *Handler) auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := routeAction(r)
+		if action == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Describe the request before handing it on
+		params := r.URL.Query()
+		event := &AuditEvent{
+			Time:   time.Now().UTC(),
+			IP:     clientIP(r),
+			Action: action,
+			Target: auditTarget(r),
+		}
+		if action == AuditSearch {
+			// Pages search by term, the API by q
+			event.Query = params.Get("term")
+			if event.Query == "" {
+				event.Query = params.Get("q")
+			}
+			if format := params.Get("format"); format != "" && format != "json" {
+				event.Action = AuditExport
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), auditKey{}, event))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Record the outcome, even once the client went away
+		ctx := context.WithoutCancel(r.Context())
+		event.Status = rec.status
+		event.Outcome = AuditSucceeded
+		if rec.status >= http.StatusBadRequest {
+			event.Outcome = AuditFailed
+		}
+		if token := currentUser(r); token != "" {
+			event.UserKey = userKey(token)
+			if event.Login == "" {
+				event.Login, _ = h.client.getLogin(ctx, token)
+			}
+		}
+		if err := h.store.AppendAudit(ctx, event); err != nil {
+			requestLogger(ctx).Error("recording audit event failed", "action", event.Action, "target", event.Target, "error", err)
+		}
+	})
+}
+
+// auditEvent returns the audit event of a request, nil for routes which
+// are not audited
+func auditEvent(ctx context.Context) *AuditEvent {
+	event, _ := ctx.Value(auditKey{}).(*AuditEvent)
+	return event
+}
+
+// routeAction returns the audit action of the route a request matched
+func routeAction(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return auditedRoutes[r.Method+" "+tmpl]
+}
+
+// auditTarget names what a route acts on from its route vars
+func auditTarget(r *http.Request) string {
+	args := mux.Vars(r)
+	switch {
+	case args["key"] != "":
+		return args["key"]
+	case args["owner"] != "" && args["repository"] != "":
+		return args["owner"] + "/" + args["repository"]
+	case args["owner"] != "":
+		return args["owner"] + "/" + args["name"]
+	}
+	return args["id"]
+}
+
+// clientIP returns the address a request came from. Behind a proxy this is
+// the address of the proxy. It is empty when the address is not an IP, as
+// on a unix socket, since the audit index only takes IPs.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
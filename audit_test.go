@@ -0,0 +1,26 @@
+package search
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"@", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1293 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt bucket names. Every user gets a top level bucket named after the
+// userKey of their token which holds their repository list. Every indexed
+// repository gets a top level bucket shared by all users, and so do its
+// pull requests. Workspaces, saved searches, the branches chosen per
+// repository, the details of viewed commits, user logins and the audit log
+// live in buckets of their own.
+var (
+	repositoriesBucket = []byte("repositories")
+	commitsBucket      = []byte("commits")
+	termsBucket        = []byte("terms")
+	workspacesBucket   = []byte("workspaces")
+	branchesBucket     = []byte("branches")
+	documentsBucket    = []byte("documents")
+	detailsBucket      = []byte("details")
+	searchesBucket     = []byte("searches")
+	usersBucket        = []byte("users")
+	auditBucket        = []byte("audit")
+)
+
+// sharedBuckets are the top level buckets which do not belong to a user
+var sharedBuckets = [][]byte{workspacesBucket, branchesBucket, detailsBucket, searchesBucket, usersBucket, auditBucket}
+
+const (
+	// minGram and maxGram mirror the n-gram filter used by Elastic Search
+	minGram = 2
+	maxGram = 20
+
+	// suggestSize mirrors the default size of a completion suggester
+	suggestSize = 5
+)
+
+// BoltStore implements Storage in a single BoltDB file, so git_engine can
+// run without an Elastic Search cluster. Commit messages and the titles of
+// their pull requests are searched with an inverted index of n-grams.
+type BoltStore struct {
+	DB *bolt.DB
+
+	log        *slog.Logger
+	reindexing sync.Mutex
+}
+
+// NewBoltStore opens or creates a BoltDB file at path, logging to logger
+func NewBoltStore(path string, logger *slog.Logger) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return migrateUserBuckets(tx, logger)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{
+		DB:  db,
+		log: logger,
+	}, nil
+}
+
+// Close closes the underlying database
+func (s *BoltStore) Close() error {
+	return s.DB.Close()
+}
+
+// UserExist checks if a user has already been created
+func (s *BoltStore) UserExist(ctx context.Context, token string) bool {
+	var exists bool
+	s.DB.View(func(tx *bolt.Tx) error {
+		exists = userBucket(tx, token) != nil
+		return nil
+	})
+	return exists
+}
+
+// RepoExists checks if the commits of a repository have been indexed
+func (s *BoltStore) RepoExists(ctx context.Context, fullName string) bool {
+	var exists bool
+	s.DB.View(func(tx *bolt.Tx) error {
+		exists = repoBucket(tx, fullName) != nil
+		return nil
+	})
+	return exists
+}
+
+// CreateUserIndex creates a new bucket for a user
+func (s *BoltStore) CreateUserIndex(ctx context.Context, token string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(userBucketKey(token))
+		return err
+	})
+}
+
+// CreateRepositoryList adds or refreshes a repository in the repository list
+func (s *BoltStore) CreateRepositoryList(ctx context.Context, token string, r *Repository) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		user := userBucket(tx, token)
+		if user == nil {
+			return ErrUserNotFound
+		}
+		repos, err := user.CreateBucketIfNotExists(repositoriesBucket)
+		if err != nil {
+			return err
+		}
+
+		// Keep the active status of a repository already listed
+		key := []byte(strconv.Itoa(r.ID))
+		repo := *r
+		if v := repos.Get(key); v != nil {
+			var existing Repository
+			if err := json.Unmarshal(v, &existing); err != nil {
+				return err
+			}
+			repo.Active = repo.Active || existing.Active
+		}
+
+		buf, err := json.Marshal(&repo)
+		if err != nil {
+			return err
+		}
+		return repos.Put(key, buf)
+	})
+}
+
+// CreateRepository indexes commits for a repository under its full name,
+// replacing the commits and inverted index built before
+func (s *BoltStore) CreateRepository(ctx context.Context, fullName string, commits []*GitCommit) ([]*IndexCommit, error) {
+	var added []*IndexCommit
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		known := make(map[string]bool)
+		if old := repoBucket(tx, fullName); old != nil {
+			old.Bucket(commitsBucket).ForEach(func(k, _ []byte) error {
+				known[string(k)] = true
+				return nil
+			})
+			if err := tx.DeleteBucket(repoKey(fullName)); err != nil {
+				return err
+			}
+		}
+		repo, err := tx.CreateBucket(repoKey(fullName))
+		if err != nil {
+			return err
+		}
+		docs, err := repo.CreateBucketIfNotExists(commitsBucket)
+		if err != nil {
+			return err
+		}
+		terms, err := repo.CreateBucketIfNotExists(termsBucket)
+		if err != nil {
+			return err
+		}
+
+		// Store each commit and add its n-grams to the inverted index
+		for _, commit := range commits {
+			row := newIndexCommit(fullName, commit)
+			buf, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			id := []byte(commit.SHA)
+			if err := docs.Put(id, buf); err != nil {
+				return err
+			}
+			if err := indexText(terms, id, row.searchable()); err != nil {
+				return err
+			}
+			if !known[commit.SHA] {
+				added = append(added, row)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	commitsIndexed.WithLabelValues(fullName).Add(float64(len(commits)))
+	s.log.Info("indexed commits", "repository", fullName, "count", len(commits), "added", len(added))
+	return added, nil
+}
+
+// CreatePullRequests indexes the pull requests and review comments of a
+// repository, replacing those indexed before
+func (s *BoltStore) CreatePullRequests(ctx context.Context, fullName string, pulls []*GitPullRequest, comments []*GitReviewComment) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		key := pullsKey(fullName)
+		if tx.Bucket(key) != nil {
+			if err := tx.DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		docs, err := bucket.CreateBucket(documentsBucket)
+		if err != nil {
+			return err
+		}
+		terms, err := bucket.CreateBucket(termsBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range newIndexPullRequests(fullName, pulls, comments) {
+			buf, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			id := []byte(doc.id)
+			if err := docs.Put(id, buf); err != nil {
+				return err
+			}
+			if err := indexText(terms, id, doc.searchable()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetPullRequests searches the pull requests and review comments of a
+// repository, best matches first
+func (s *BoltStore) GetPullRequests(ctx context.Context, fullName string, q *SearchQuery) ([]*IndexPullRequest, error) {
+	var pulls []*IndexPullRequest
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pullsKey(fullName))
+		if bucket == nil {
+			return nil
+		}
+		docs := bucket.Bucket(documentsBucket)
+		for _, id := range matchText(docs, bucket.Bucket(termsBucket), q.Term) {
+			var pull IndexPullRequest
+			if err := json.Unmarshal(docs.Get([]byte(id)), &pull); err != nil {
+				return err
+			}
+			if q.Wants(pull.Type) {
+				pulls = append(pulls, &pull)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resultPage(pulls, q), nil
+}
+
+// CountPullRequests counts the matching pull requests and review comments
+func (s *BoltStore) CountPullRequests(ctx context.Context, fullName string, q *SearchQuery) (int, error) {
+	pulls, err := s.GetPullRequests(ctx, fullName, q.unpaged())
+	return len(pulls), err
+}
+
+// ActivateRepository activates a repository by its full name
+func (s *BoltStore) ActivateRepository(ctx context.Context, token, fullName string) error {
+	return s.setActive(token, fullName, true)
+}
+
+// DeactivateRepository deactivates a repository by its full name
+func (s *BoltStore) DeactivateRepository(ctx context.Context, token, fullName string) error {
+	return s.setActive(token, fullName, false)
+}
+
+// setActive sets the active status of a repository in the repository list
+func (s *BoltStore) setActive(token, fullName string, active bool) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		repos, err := repositoryList(tx, token)
+		if err != nil {
+			return err
+		}
+
+		c := repos.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var repo Repository
+			if err := json.Unmarshal(v, &repo); err != nil {
+				return err
+			} else if repo.FullName != fullName {
+				continue
+			}
+
+			repo.Active = active
+			buf, err := json.Marshal(&repo)
+			if err != nil {
+				return err
+			}
+			return repos.Put(k, buf)
+		}
+		return ErrRepoNotFound
+	})
+}
+
+// GetCommits returns commits for a given repository whose message shares
+// a term with the query, best matches first and newest first among equal
+// matches. Without a term every commit passing the filters matches.
+func (s *BoltStore) GetCommits(ctx context.Context, fullName string, q *SearchQuery) ([]*IndexCommit, error) {
+	var commits []*IndexCommit
+	scores := make(map[*IndexCommit]int)
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		repo := repoBucket(tx, fullName)
+		if repo == nil {
+			return ErrRepoNotFound
+		}
+		docs := repo.Bucket(commitsBucket)
+		for id, score := range scoreText(docs, repo.Bucket(termsBucket), q.Term) {
+			var commit IndexCommit
+			if err := json.Unmarshal(docs.Get([]byte(id)), &commit); err != nil {
+				return err
+			}
+			if q.Matches(&commit) {
+				commits = append(commits, &commit)
+				scores[&commit] = score
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(commits, func(i, j int) bool {
+		if scores[commits[i]] != scores[commits[j]] {
+			return scores[commits[i]] > scores[commits[j]]
+		}
+		return newerCommit(commits[i], commits[j])
+	})
+	return resultPage(commits, q), nil
+}
+
+// CountCommits counts the matching commits of a repository
+func (s *BoltStore) CountCommits(ctx context.Context, fullName string, q *SearchQuery) (int, error) {
+	commits, err := s.GetCommits(ctx, fullName, q.unpaged())
+	return len(commits), err
+}
+
+// ScrollCommits calls fn for every matching commit, newest first
+func (s *BoltStore) ScrollCommits(ctx context.Context, fullName string, q *SearchQuery, fn func(*IndexCommit) error) error {
+	commits, err := s.GetCommits(ctx, fullName, q.unpaged())
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(commits, func(i, j int) bool { return commits[i].Date.After(commits[j].Date) })
+	for _, commit := range commits {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(commit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRepositories suggests repositories starting with search
+func (s *BoltStore) GetRepositories(ctx context.Context, token, search string) ([]*Repository, error) {
+	prefix := strings.ToLower(search)
+	var repos []*Repository
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		list, err := repositoryList(tx, token)
+		if err != nil {
+			return err
+		}
+		return list.ForEach(func(_, v []byte) error {
+			var repo Repository
+			if err := json.Unmarshal(v, &repo); err != nil {
+				return err
+			}
+			if strings.HasPrefix(strings.ToLower(repo.Name), prefix) ||
+				strings.HasPrefix(strings.ToLower(repo.FullName), prefix) {
+				repos = append(repos, &repo)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	if len(repos) > suggestSize {
+		repos = repos[:suggestSize]
+	}
+	return repos, nil
+}
+
+// GetRepository looks up a repository in the repository list
+func (s *BoltStore) GetRepository(ctx context.Context, token, fullName string) (*Repository, error) {
+	var found *Repository
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		list, err := repositoryList(tx, token)
+		if err != nil {
+			return err
+		}
+		return list.ForEach(func(_, v []byte) error {
+			var repo Repository
+			if err := json.Unmarshal(v, &repo); err != nil {
+				return err
+			}
+			if repo.FullName == fullName {
+				found = &repo
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	} else if found == nil {
+		return nil, ErrRepoNotFound
+	}
+	return found, nil
+}
+
+// Ready checks the database is open
+func (s *BoltStore) Ready(ctx context.Context) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// CountActiveRepositories counts the active repositories of every user
+func (s *BoltStore) CountActiveRepositories(ctx context.Context) (int, error) {
+	count := 0
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			list := b.Bucket(repositoriesBucket)
+			if list == nil {
+				return nil
+			}
+			return list.ForEach(func(_, v []byte) error {
+				var repo Repository
+				if err := json.Unmarshal(v, &repo); err != nil {
+					return err
+				}
+				if repo.Active {
+					count++
+				}
+				return nil
+			})
+		})
+	})
+	return count, err
+}
+
+// GetActiveRepositories retrieves active repositories
+func (s *BoltStore) GetActiveRepositories(ctx context.Context, token string) ([]*Repository, error) {
+	var repos []*Repository
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		list, err := repositoryList(tx, token)
+		if err != nil {
+			return err
+		}
+		return list.ForEach(func(_, v []byte) error {
+			var repo Repository
+			if err := json.Unmarshal(v, &repo); err != nil {
+				return err
+			}
+			if repo.Active {
+				repos = append(repos, &repo)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+// SaveCommitDetail stores the details of a commit
+func (s *BoltStore) SaveCommitDetail(ctx context.Context, detail *CommitDetail) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(detailsBucket)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(detail)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(commitID(detail.Repository, detail.SHA)), buf)
+	})
+}
+
+// GetCommitDetail retrieves the stored details of a commit
+func (s *BoltStore) GetCommitDetail(ctx context.Context, fullName, sha string) (*CommitDetail, error) {
+	var detail *CommitDetail
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(detailsBucket)
+		if bucket == nil {
+			return ErrCommitNotFound
+		}
+		v := bucket.Get([]byte(commitID(fullName, sha)))
+		if v == nil {
+			return ErrCommitNotFound
+		}
+		return json.Unmarshal(v, &detail)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// SetBranches chooses the branches indexed for a repository
+func (s *BoltStore) SetBranches(ctx context.Context, fullName string, branches []string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(branchesBucket)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(branches)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fullName), buf)
+	})
+}
+
+// GetBranches returns the branches indexed for a repository
+func (s *BoltStore) GetBranches(ctx context.Context, fullName string) ([]string, error) {
+	var branches []string
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(branchesBucket)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte(fullName))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &branches)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return branches, nil
+}
+
+// SaveSearch creates or replaces a saved search
+func (s *BoltStore) SaveSearch(ctx context.Context, ss *SavedSearch) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		searches, err := tx.CreateBucketIfNotExists(searchesBucket)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(newStoredSearch(ss))
+		if err != nil {
+			return err
+		}
+		return searches.Put([]byte(ss.ID), buf)
+	})
+}
+
+// GetSearch retrieves a saved search by id
+func (s *BoltStore) GetSearch(ctx context.Context, id string) (*SavedSearch, error) {
+	var ss *SavedSearch
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		searches := tx.Bucket(searchesBucket)
+		if searches == nil {
+			return ErrSearchNotFound
+		}
+		v := searches.Get([]byte(id))
+		if v == nil {
+			return ErrSearchNotFound
+		}
+		var err error
+		ss, err = decodeSearch(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// GetSearches lists the saved searches of a Github user
+func (s *BoltStore) GetSearches(ctx context.Context, login string) ([]*SavedSearch, error) {
+	return s.savedSearches(ctx, func(ss *SavedSearch) bool { return ss.Owner == login })
+}
+
+// DeleteSearch removes a saved search
+func (s *BoltStore) DeleteSearch(ctx context.Context, id string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		searches := tx.Bucket(searchesBucket)
+		if searches == nil || searches.Get([]byte(id)) == nil {
+			return ErrSearchNotFound
+		}
+		return searches.Delete([]byte(id))
+	})
+}
+
+// MatchSearches runs the saved searches of a repository against new
+// commits, matching terms the way GetCommits does
+func (s *BoltStore) MatchSearches(ctx context.Context, fullName string, commits []*IndexCommit) ([]*Alert, error) {
+	searches, err := s.savedSearches(ctx, func(ss *SavedSearch) bool { return ss.Repository == fullName })
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []*Alert
+	for _, ss := range searches {
+		alert := &Alert{Search: ss}
+		q := ss.Query()
+		for _, commit := range commits {
+			if q.Matches(commit) && matchesTerm(commit.searchable(), q.Term) {
+				alert.Commits = append(alert.Commits, commit)
+			}
+		}
+		if len(alert.Commits) > 0 {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts, nil
+}
+
+func (s *BoltStore) savedSearches(ctx context.Context, keep func(*SavedSearch) bool) ([]*SavedSearch, error) {
+	var found []*SavedSearch
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		searches := tx.Bucket(searchesBucket)
+		if searches == nil {
+			return nil
+		}
+		return searches.ForEach(func(_, v []byte) error {
+			ss, err := decodeSearch(v)
+			if err != nil {
+				return err
+			}
+			if keep(ss) {
+				found = append(found, ss)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// SaveWorkspace creates or replaces a workspace
+func (s *BoltStore) SaveWorkspace(ctx context.Context, ws *Workspace) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		workspaces, err := tx.CreateBucketIfNotExists(workspacesBucket)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(ws)
+		if err != nil {
+			return err
+		}
+		return workspaces.Put([]byte(ws.ID), buf)
+	})
+}
+
+// GetWorkspace retrieves a workspace by id
+func (s *BoltStore) GetWorkspace(ctx context.Context, id string) (*Workspace, error) {
+	var ws *Workspace
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		workspaces := tx.Bucket(workspacesBucket)
+		if workspaces == nil {
+			return ErrWorkspaceNotFound
+		}
+		v := workspaces.Get([]byte(id))
+		if v == nil {
+			return ErrWorkspaceNotFound
+		}
+		return json.Unmarshal(v, &ws)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// AddWorkspaceMember adds a Github user to a workspace
+func (s *BoltStore) AddWorkspaceMember(ctx context.Context, id, login string) error {
+	return s.updateWorkspace(id, func(ws *Workspace) bool { return ws.addMember(login) })
+}
+
+// AddWorkspaceRepository adds a repository to a workspace
+func (s *BoltStore) AddWorkspaceRepository(ctx context.Context, id, fullName string) error {
+	return s.updateWorkspace(id, func(ws *Workspace) bool { return ws.addRepository(fullName) })
+}
+
+// updateWorkspace reads, changes and writes a workspace in one transaction
+func (s *BoltStore) updateWorkspace(id string, change func(*Workspace) bool) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		workspaces := tx.Bucket(workspacesBucket)
+		if workspaces == nil {
+			return ErrWorkspaceNotFound
+		}
+		v := workspaces.Get([]byte(id))
+		if v == nil {
+			return ErrWorkspaceNotFound
+		}
+		var ws Workspace
+		if err := json.Unmarshal(v, &ws); err != nil {
+			return err
+		}
+		if !change(&ws) {
+			return nil
+		}
+		buf, err := json.Marshal(&ws)
+		if err != nil {
+			return err
+		}
+		return workspaces.Put([]byte(id), buf)
+	})
+}
+
+// GetWorkspaces retrieves the workspaces a Github user is a member of
+func (s *BoltStore) GetWorkspaces(ctx context.Context, login string) ([]*Workspace, error) {
+	var found []*Workspace
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		workspaces := tx.Bucket(workspacesBucket)
+		if workspaces == nil {
+			return nil
+		}
+		return workspaces.ForEach(func(_, v []byte) error {
+			var ws Workspace
+			if err := json.Unmarshal(v, &ws); err != nil {
+				return err
+			}
+			if ws.HasMember(login) {
+				found = append(found, &ws)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Reindex moves commits stored per user, from before commits were shared,
+// into shared repository buckets by fetching the active repositories of
+// every such user again. Everything else is stored as JSON and needs no
+// migration. Only one reindex runs at a time.
+func (s *BoltStore) Reindex(ctx context.Context, fetch CommitFetcher) error {
+	if !s.reindexing.TryLock() {
+		return ErrReindexRunning
+	}
+	defer s.reindexing.Unlock()
+
+	// Find the per user copies and the repositories they belong to
+	legacy := make(map[string][][]byte)
+	var fullNames []string
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, user *bolt.Bucket) error {
+			if !isUserBucket(name) {
+				return nil
+			}
+			var keys [][]byte
+			user.ForEach(func(k, v []byte) error {
+				if v == nil && bytes.HasPrefix(k, repoPrefix) {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if len(keys) == 0 {
+				return nil
+			}
+			legacy[string(name)] = keys
+			list := user.Bucket(repositoriesBucket)
+			if list == nil {
+				return nil
+			}
+			return list.ForEach(func(_, v []byte) error {
+				var repo Repository
+				if err := json.Unmarshal(v, &repo); err != nil {
+					return err
+				}
+				if repo.Active {
+					fullNames = append(fullNames, repo.FullName)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+
+	// Fetch the commits of active repositories into shared buckets
+	var missing []string
+	for _, fullName := range fullNames {
+		if !s.RepoExists(ctx, fullName) {
+			missing = append(missing, fullName)
+		}
+	}
+	err = refetchRepositories(ctx, s.log, missing, fetch, func(fullName string, commits []*GitCommit) error {
+		_, err := s.CreateRepository(ctx, fullName, commits)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Drop the per user copies
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		for name, keys := range legacy {
+			user := tx.Bucket([]byte(name))
+			if user == nil {
+				continue
+			}
+			for _, k := range keys {
+				if err := user.DeleteBucket(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// SaveLogin records the Github login of a user as they sign in
+func (s *BoltStore) SaveLogin(ctx context.Context, token, login string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(&userRecord{Key: userKey(token), Login: login, LastLogin: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		return users.Put([]byte(userKey(token)), buf)
+	})
+}
+
+// GetUsers lists the user buckets, their logins and active repositories
+func (s *BoltStore) GetUsers(ctx context.Context) ([]*UserSummary, error) {
+	summaries := []*UserSummary{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !isUserBucket(name) {
+				return nil
+			}
+			user := &UserSummary{Key: string(bytes.TrimPrefix(name, userPrefix)), Repositories: []string{}}
+			if users != nil {
+				if v := users.Get([]byte(user.Key)); v != nil {
+					var record userRecord
+					if err := json.Unmarshal(v, &record); err != nil {
+						return err
+					}
+					user.Login, user.LastLogin = record.Login, &record.LastLogin
+				}
+			}
+			if list := b.Bucket(repositoriesBucket); list != nil {
+				err := list.ForEach(func(_, v []byte) error {
+					var repo Repository
+					if err := json.Unmarshal(v, &repo); err != nil {
+						return err
+					}
+					if repo.Active {
+						user.Repositories = append(user.Repositories, repo.FullName)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			sort.Strings(user.Repositories)
+			summaries = append(summaries, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Key < summaries[j].Key })
+	return summaries, nil
+}
+
+// DeleteUser removes the bucket and login of a user, their saved searches
+// and their membership of workspaces
+func (s *BoltStore) DeleteUser(ctx context.Context, key string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		name := append(append([]byte(nil), userPrefix...), key...)
+		if tx.Bucket(name) == nil {
+			return ErrUserNotFound
+		}
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+
+		// Look the login up, users who have not signed in since logins
+		// were recorded have nothing else to remove
+		users := tx.Bucket(usersBucket)
+		if users == nil || users.Get([]byte(key)) == nil {
+			return nil
+		}
+		var record userRecord
+		if err := json.Unmarshal(users.Get([]byte(key)), &record); err != nil {
+			return err
+		}
+		if err := users.Delete([]byte(key)); err != nil {
+			return err
+		}
+
+		if searches := tx.Bucket(searchesBucket); searches != nil {
+			var owned [][]byte
+			err := searches.ForEach(func(k, v []byte) error {
+				var ss SavedSearch
+				if err := json.Unmarshal(v, &ss); err != nil {
+					return err
+				}
+				if ss.Owner == record.Login {
+					owned = append(owned, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range owned {
+				if err := searches.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		if workspaces := tx.Bucket(workspacesBucket); workspaces != nil {
+			updated := make(map[string][]byte)
+			err := workspaces.ForEach(func(k, v []byte) error {
+				var ws Workspace
+				if err := json.Unmarshal(v, &ws); err != nil {
+					return err
+				}
+				if !contains(ws.Members, record.Login) {
+					return nil
+				}
+				ws.Members = without(ws.Members, record.Login)
+				buf, err := json.Marshal(&ws)
+				if err != nil {
+					return err
+				}
+				updated[string(k)] = buf
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, buf := range updated {
+				if err := workspaces.Put([]byte(k), buf); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetStats reports the size of the database file and the commits and pull
+// requests stored per repository. The database counts as a single index
+// holding the commits and pull request documents of every repository.
+func (s *BoltStore) GetStats(ctx context.Context) (*StorageStats, error) {
+	repos := make(map[string]*RepositoryStats)
+	db := &IndexStats{Name: s.DB.Path()}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		db.Bytes = tx.Size()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			var fullName string
+			switch {
+			case bytes.HasPrefix(name, repoPrefix):
+				fullName = string(bytes.TrimPrefix(name, repoPrefix))
+			case bytes.HasPrefix(name, pullsPrefix):
+				fullName = string(bytes.TrimPrefix(name, pullsPrefix))
+			default:
+				return nil
+			}
+			if repos[fullName] == nil {
+				repos[fullName] = &RepositoryStats{Repository: fullName}
+			}
+			rs := repos[fullName]
+
+			if commits := b.Bucket(commitsBucket); commits != nil {
+				rs.Commits = int64(commits.Stats().KeyN)
+				db.Documents += rs.Commits
+			}
+			if docs := b.Bucket(documentsBucket); docs != nil {
+				return docs.ForEach(func(_, v []byte) error {
+					var doc IndexPullRequest
+					if err := json.Unmarshal(v, &doc); err != nil {
+						return err
+					}
+					if doc.Type == DocPullRequest {
+						rs.PullRequests++
+					}
+					db.Documents++
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &StorageStats{Indices: []*IndexStats{db}, Repositories: repositoryStats(repos)}, nil
+}
+
+// AppendAudit records an event in the audit log, keyed by a sequence so
+// events keep the order they were recorded in
+func (s *BoltStore) AppendAudit(ctx context.Context, event *AuditEvent) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		audit, err := tx.CreateBucketIfNotExists(auditBucket)
+		if err != nil {
+			return err
+		}
+		seq, err := audit.NextSequence()
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return audit.Put(key, buf)
+	})
+}
+
+// GetAuditEvents lists the latest events of the audit log matching a
+// query, newest first
+func (s *BoltStore) GetAuditEvents(ctx context.Context, q *AuditQuery) ([]*AuditEvent, error) {
+	events := []*AuditEvent{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		audit := tx.Bucket(auditBucket)
+		if audit == nil {
+			return nil
+		}
+		c := audit.Cursor()
+		for k, v := c.Last(); k != nil && len(events) < q.Limit; k, v = c.Prev() {
+			var event AuditEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if q.Matches(&event) {
+				events = append(events, &event)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// isUserBucket reports whether a top level bucket holds the repository list
+// of a user
+func isUserBucket(name []byte) bool {
+	return bytes.HasPrefix(name, userPrefix)
+}
+
+// tokenPattern matches Github tokens: 40 hex digits for classic OAuth
+// tokens, a gh*_ prefix for newer ones
+var tokenPattern = regexp.MustCompile(`^(?:[0-9a-f]{40}|gh[a-z]_[A-Za-z0-9_]+)$`)
+
+// isKnownBucket reports whether a top level bucket is one git_engine names
+// itself
+func isKnownBucket(name []byte) bool {
+	if bytes.HasPrefix(name, repoPrefix) || bytes.HasPrefix(name, pullsPrefix) || bytes.HasPrefix(name, userPrefix) {
+		return true
+	}
+	for _, shared := range sharedBuckets {
+		if bytes.Equal(name, shared) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLegacyUserBucket reports whether a top level bucket holds the repository
+// list of a user under their raw token, as stored before buckets were named
+// after the userKey
+func isLegacyUserBucket(name []byte) bool {
+	return !isKnownBucket(name) && tokenPattern.Match(name)
+}
+
+// migrateUserBuckets moves user buckets named after raw tokens to buckets
+// named after their userKey, so the database file holds no Github tokens.
+// Unknown buckets are logged and left alone.
+func migrateUserBuckets(tx *bolt.Tx, logger *slog.Logger) error {
+	var legacy [][]byte
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if isLegacyUserBucket(name) {
+			legacy = append(legacy, append([]byte(nil), name...))
+		} else if !isKnownBucket(name) {
+			logger.Warn("ignored unknown bucket", "bucket", strconv.Quote(string(name)))
+		}
+		return nil
+	})
+	for _, name := range legacy {
+		dst, err := tx.CreateBucketIfNotExists(userBucketKey(string(name)))
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(dst, tx.Bucket(name)); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBucket copies the keys and nested buckets of src into dst
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nested, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
+
+func repositoryList(tx *bolt.Tx, token string) (*bolt.Bucket, error) {
+	user := userBucket(tx, token)
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	repos := user.Bucket(repositoriesBucket)
+	if repos == nil {
+		return nil, ErrRepoTypeMissing
+	}
+	return repos, nil
+}
+
+// userPrefix prefixes the bucket of every user
+var userPrefix = []byte("user:")
+
+func userBucketKey(token string) []byte {
+	return append(append([]byte(nil), userPrefix...), userKey(token)...)
+}
+
+func userBucket(tx *bolt.Tx, token string) *bolt.Bucket {
+	return tx.Bucket(userBucketKey(token))
+}
+
+// repoPrefix prefixes the bucket of every indexed repository
+var repoPrefix = []byte("repo:")
+
+func repoKey(fullName string) []byte {
+	return append(append([]byte(nil), repoPrefix...), fullName...)
+}
+
+func repoBucket(tx *bolt.Tx, fullName string) *bolt.Bucket {
+	return tx.Bucket(repoKey(fullName))
+}
+
+// pullsPrefix prefixes the bucket of the pull requests of a repository
+var pullsPrefix = []byte("pulls:")
+
+func pullsKey(fullName string) []byte {
+	return append(append([]byte(nil), pullsPrefix...), fullName...)
+}
+
+// indexText adds the n-grams of text to the inverted index for a document
+func indexText(terms *bolt.Bucket, id []byte, text string) error {
+	for _, gram := range ngrams(text) {
+		postings, err := terms.CreateBucketIfNotExists([]byte(gram))
+		if err != nil {
+			return err
+		}
+		if err := postings.Put(id, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesTerm checks if text shares a term with query, as the inverted
+// index would. An empty query matches any text.
+func matchesTerm(text, query string) bool {
+	return len(tokenize(query)) == 0 || termScore(text, query) > 0
+}
+
+// termScore counts the terms of query found in text, scoring text the way
+// matchText scores documents
+func termScore(text, query string) int {
+	grams := make(map[string]bool)
+	for _, gram := range ngrams(text) {
+		grams[gram] = true
+	}
+	score := 0
+	for _, term := range tokenize(query) {
+		if runes := []rune(term); len(runes) > maxGram {
+			term = string(runes[:maxGram])
+		}
+		if grams[term] {
+			score++
+		}
+	}
+	return score
+}
+
+// matchText returns the ids of the documents sharing a term with query,
+// ordered by the number of terms matched then by id. An empty query matches
+// every document.
+func matchText(docs, terms *bolt.Bucket, query string) []string {
+	scores := scoreText(docs, terms, query)
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// scoreText counts the terms of query each document shares, by id. An
+// empty query matches every document with a score of zero.
+func scoreText(docs, terms *bolt.Bucket, query string) map[string]int {
+	scores := make(map[string]int)
+	if query == "" {
+		docs.ForEach(func(k, _ []byte) error {
+			scores[string(k)] = 0
+			return nil
+		})
+	}
+	for _, term := range tokenize(query) {
+		if runes := []rune(term); len(runes) > maxGram {
+			term = string(runes[:maxGram])
+		}
+		postings := terms.Bucket([]byte(term))
+		if postings == nil {
+			continue
+		}
+		postings.ForEach(func(k, _ []byte) error {
+			scores[string(k)]++
+			return nil
+		})
+	}
+	return scores
+}
+
+// tokenize splits text into lowercase words like the standard analyzer
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ngrams returns the distinct n-grams of every word in text
+func ngrams(text string) []string {
+	seen := make(map[string]bool)
+	var grams []string
+	for _, word := range tokenize(text) {
+		runes := []rune(word)
+		for i := range runes {
+			for n := minGram; n <= maxGram && i+n <= len(runes); n++ {
+				gram := string(runes[i : i+n])
+				if !seen[gram] {
+					seen[gram] = true
+					grams = append(grams, gram)
+				}
+			}
+		}
+	}
+	return grams
+}
@@ -0,0 +1,59 @@
+package search
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltMigrateUserBuckets(t *testing.T) {
+	const classic = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		name      string
+		bucket    string
+		wantMoved bool
+		wantKept  bool
+	}{
+		{"classic token", classic, true, false},
+		{"prefixed token", "gho_octocat", true, false},
+		{"unknown bucket", "backup", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "git_engine.db")
+			db, err := bolt.Open(path, 0600, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Update(func(tx *bolt.Tx) error {
+				user, err := tx.CreateBucket([]byte(tt.bucket))
+				if err != nil {
+					return err
+				}
+				_, err = user.CreateBucket(repositoriesBucket)
+				return err
+			})
+			db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Only buckets named like a token are moved to the userKey
+			store, err := NewBoltStore(path, testLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			store.DB.View(func(tx *bolt.Tx) error {
+				if moved := tx.Bucket(userBucketKey(tt.bucket)) != nil; moved != tt.wantMoved {
+					t.Errorf("bucket moved = %v, want %v", moved, tt.wantMoved)
+				}
+				if kept := tx.Bucket([]byte(tt.bucket)) != nil; kept != tt.wantKept {
+					t.Errorf("bucket kept = %v, want %v", kept, tt.wantKept)
+				}
+				return nil
+			})
+		})
+	}
+}
@@ -1,150 +1,659 @@
 package search
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultGithubAPI and DefaultGithubURL locate the Github API and the site
+// serving OAuth logins when no other Github is configured
+const (
+	DefaultGithubAPI = "https://api.github.com"
+	DefaultGithubURL = "https://github.com"
+)
+
+// maxRateLimitWait is the longest a request will wait for the rate limit to
+// reset before giving up with ErrRateLimited
+const maxRateLimitWait = time.Minute
+
+// maxCacheEntries bounds the responses kept for conditional requests. The
+// least recently used one is dropped first.
+const maxCacheEntries = 4096
+
+var (
+	// ErrRateLimited is returned when the Github rate limit has been exhausted
+	ErrRateLimited = errors.New("github rate limit exceeded")
+
+	// ErrNotFound is returned when a Github resource does not exist
+	ErrNotFound = errors.New("github resource not found")
+
+	// ErrUnauthorized is returned when Github rejects the access token
+	ErrUnauthorized = errors.New("github token unauthorized")
 )
 
 // Client holds relevant
 type Client struct {
-	baseURL *url.URL
+	apiURL  url.URL
+	webURL  url.URL
 	secrets map[string]string
+
+	mu     sync.Mutex
+	limits map[string]rateLimit
+	cache  map[string]*list.Element
+	recent *list.List
+	logins map[string]string
+
+	http *http.Client
+	log  *slog.Logger
+}
+
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// cacheEntry holds a response cached for a user, identified by their
+// userKey, and the URL it was fetched from
+type cacheEntry struct {
+	user string
+	key  string
+	etag string
+	body []byte
+	next string
 }
 
-// NewClient creates a new instance of Client
-func NewClient(secrets map[string]string) *Client {
-	url := new(url.URL)
-	url.Host = "api.github.com"
-	url.Scheme = "https"
+// NewClient creates a new instance of Client for the Github API at apiURL
+// and the OAuth site at webURL, sending requests through httpClient and
+// logging to logger. Both URLs are copied.
+func NewClient(secrets map[string]string, apiURL, webURL *url.URL, httpClient *http.Client, logger *slog.Logger) *Client {
 	return &Client{
-		baseURL: url,
+		apiURL:  *apiURL,
+		webURL:  *webURL,
 		secrets: secrets,
+		limits:  make(map[string]rateLimit),
+		cache:   make(map[string]*list.Element),
+		recent:  list.New(),
+		logins:  make(map[string]string),
+		http:    httpClient,
+		log:     logger,
 	}
 }
 
-func (c *Client) getCommits(token, name, owner string) ([]*GitCommit, error) {
-	// Create URL
-	u := c.baseURL
-	u.Path = fmt.Sprintf("/repos/%s/%s/commits", owner, name)
+// getCommits lists every commit reachable from a branch, or from the
+// default branch when branch is empty
+func (c *Client) getCommits(ctx context.Context, token, name, owner, branch string) ([]*GitCommit, error) {
+	params := url.Values{}
+	params.Set("per_page", "100")
+	if branch != "" {
+		params.Set("sha", branch)
+	}
+	path := fmt.Sprintf("/repos/%s/%s/commits", owner, name)
+	return getPages[*GitCommit](ctx, c, token, path, params)
+}
 
-	// Create request
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
+// getBranchCommits lists the commits of several branches once each, and
+// records on every commit the branches and tags that contain it. Without
+// branches the default branch is used.
+func (c *Client) getBranchCommits(ctx context.Context, token, owner, name string, branches []string) ([]*GitCommit, error) {
+	if len(branches) == 0 {
+		repo, err := c.getRepository(ctx, token, owner, name)
+		if err != nil {
+			return nil, err
+		}
+		branches = []string{repo.DefaultBranch}
+	}
+
+	// Walk every branch, merging commits they share
+	bySHA := make(map[string]*GitCommit)
+	var commits []*GitCommit
+	for _, branch := range branches {
+		page, err := c.getCommits(ctx, token, name, owner, branch)
+		if err != nil {
+			return nil, err
+		}
+		for _, commit := range page {
+			if known, ok := bySHA[commit.SHA]; ok {
+				commit = known
+			} else {
+				bySHA[commit.SHA] = commit
+				commits = append(commits, commit)
+			}
+			commit.Branches = append(commit.Branches, branch)
+		}
 	}
-	req.Header.Add("Authorization", "token "+token)
 
-	// Send request
-	resp, err := http.DefaultClient.Do(req)
+	// A tag contains its commit and every ancestor of it
+	tags, err := c.getTags(ctx, token, owner, name)
 	if err != nil {
 		return nil, err
 	}
+	for _, tag := range tags {
+		if tag.Commit != nil {
+			markAncestors(bySHA, tag.Commit.SHA, tag.Name)
+		}
+	}
 
-	// Parse response
-	var commits []*GitCommit
-	err = json.NewDecoder(resp.Body).Decode(&commits)
-	defer resp.Body.Close()
+	issuesURL := c.oauthURL(fmt.Sprintf("/%s/%s/issues", owner, name), nil)
+	for _, commit := range commits {
+		commit.issuesURL = issuesURL
+	}
+
+	// Link commits to the pull requests holding them or merged as them.
+	// The pull requests are listed once rather than once per commit.
+	pulls, err := c.getPullRequests(ctx, token, owner, name)
 	if err != nil {
 		return nil, err
 	}
+	for _, pull := range pulls {
+		pullCommits, err := c.getPullRequestCommits(ctx, token, owner, name, pull.Number)
+		if err != nil {
+			return nil, err
+		}
+		shas := pull.commitSHAs()
+		for _, commit := range pullCommits {
+			shas = append(shas, commit.SHA)
+		}
+		linked := make(map[string]bool)
+		for _, sha := range shas {
+			if commit, ok := bySHA[sha]; ok && !linked[sha] {
+				linked[sha] = true
+				commit.PullRequests = append(commit.PullRequests, pull)
+			}
+		}
+	}
 
 	return commits, nil
 }
 
-func (c *Client) getRepositories(token string) ([]*Repository, error) {
-	// Create URL
-	u := c.baseURL
-	u.Path = "/user/repos"
+// markAncestors adds tag to a commit and all of its known ancestors
+func markAncestors(bySHA map[string]*GitCommit, sha, tag string) {
+	pending := []string{sha}
+	seen := make(map[string]bool)
+	for len(pending) > 0 {
+		sha, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		commit, ok := bySHA[sha]
+		if !ok || seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		commit.Tags = append(commit.Tags, tag)
+		for _, parent := range commit.Parents {
+			pending = append(pending, parent.SHA)
+		}
+	}
+}
 
-	// Create request
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
+// getCommit retrieves a single commit with its files and patches
+func (c *Client) getCommit(ctx context.Context, token, owner, name, sha string) (*GitCommit, error) {
+	var commit GitCommit
+	path := fmt.Sprintf("/repos/%s/%s/commits/%s", owner, name, sha)
+	if err := c.get(ctx, token, path, nil, &commit); err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", "token "+token)
+	return &commit, nil
+}
+
+// getPullRequests lists every pull request of a repository, open or closed
+func (c *Client) getPullRequests(ctx context.Context, token, owner, name string) ([]*GitPullRequest, error) {
+	params := url.Values{}
+	params.Set("state", "all")
+	params.Set("per_page", "100")
+	return getPages[*GitPullRequest](ctx, c, token, fmt.Sprintf("/repos/%s/%s/pulls", owner, name), params)
+}
+
+// getPullRequestCommits lists the commits of a pull request. Github lists
+// at most 250 of them.
+func (c *Client) getPullRequestCommits(ctx context.Context, token, owner, name string, number int) ([]*GitCommit, error) {
+	params := url.Values{}
+	params.Set("per_page", "100")
+	return getPages[*GitCommit](ctx, c, token, fmt.Sprintf("/repos/%s/%s/pulls/%d/commits", owner, name, number), params)
+}
+
+// getReviewComments lists the review comments of every pull request of a
+// repository
+func (c *Client) getReviewComments(ctx context.Context, token, owner, name string) ([]*GitReviewComment, error) {
+	params := url.Values{}
+	params.Set("per_page", "100")
+	return getPages[*GitReviewComment](ctx, c, token, fmt.Sprintf("/repos/%s/%s/pulls/comments", owner, name), params)
+}
+
+func (c *Client) getBranches(ctx context.Context, token, owner, name string) ([]*Ref, error) {
+	params := url.Values{}
+	params.Set("per_page", "100")
+	return getPages[*Ref](ctx, c, token, fmt.Sprintf("/repos/%s/%s/branches", owner, name), params)
+}
 
-	// Send request
-	resp, err := http.DefaultClient.Do(req)
+func (c *Client) getTags(ctx context.Context, token, owner, name string) ([]*Ref, error) {
+	params := url.Values{}
+	params.Set("per_page", "100")
+	return getPages[*Ref](ctx, c, token, fmt.Sprintf("/repos/%s/%s/tags", owner, name), params)
+}
+
+// getRepositories lists every repository the user can access: their own,
+// those they collaborate on and those of their organizations
+func (c *Client) getRepositories(ctx context.Context, token string) ([]*Repository, error) {
+	params := url.Values{}
+	params.Set("affiliation", "owner,collaborator,organization_member")
+	params.Set("per_page", "100")
+	repos, err := getPages[*Repository](ctx, c, token, "/user/repos", params)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse response
-	var repos []*Repository
-	if err = json.NewDecoder(resp.Body).Decode(&repos); err != nil {
-		fmt.Println(err.Error())
+	// Add organization repositories not reachable through /user/repos
+	orgs, err := c.getOrganizations(ctx, token)
+	if err != nil {
 		return nil, err
 	}
+	seen := make(map[int]bool)
+	for _, repo := range repos {
+		seen[repo.ID] = true
+	}
+	for _, org := range orgs {
+		orgRepos, err := c.getOrganizationRepositories(ctx, token, org.Login)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range orgRepos {
+			if !seen[repo.ID] {
+				seen[repo.ID] = true
+				repos = append(repos, repo)
+			}
+		}
+	}
 
 	return repos, nil
 }
 
-func (c *Client) getUsername(token string) (string, error) {
-	// Create URL
-	u := c.baseURL
-	u.Path = "/user"
+func (c *Client) getRepository(ctx context.Context, token, owner, name string) (*Repository, error) {
+	var repo Repository
+	path := fmt.Sprintf("/repos/%s/%s", owner, name)
+	if err := c.get(ctx, token, path, nil, &repo); err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+func (c *Client) getOrganizations(ctx context.Context, token string) ([]*Organization, error) {
+	params := url.Values{}
+	params.Set("per_page", "100")
+	return getPages[*Organization](ctx, c, token, "/user/orgs", params)
+}
+
+func (c *Client) getOrganizationRepositories(ctx context.Context, token, org string) ([]*Repository, error) {
+	params := url.Values{}
+	params.Set("per_page", "100")
+	return getPages[*Repository](ctx, c, token, fmt.Sprintf("/orgs/%s/repos", org), params)
+}
+
+func (c *Client) getUsername(ctx context.Context, token string) (string, error) {
+	var user User
+	if err := c.get(ctx, token, "/user", nil, &user); err != nil {
+		return "", err
+	}
+	return user.Username, nil
+}
+
+// getLogin returns the login of a token like getUsername, asking Github
+// only the first time a session is seen as the login of a token never
+// changes. Past maxCacheEntries sessions an arbitrary one is forgotten.
+func (c *Client) getLogin(ctx context.Context, token string) (string, error) {
+	user := userKey(token)
+	c.mu.Lock()
+	login, ok := c.logins[user]
+	c.mu.Unlock()
+	if ok {
+		return login, nil
+	}
+
+	login, err := c.getUsername(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.logins {
+		if len(c.logins) < maxCacheEntries {
+			break
+		}
+		delete(c.logins, key)
+	}
+	c.logins[user] = login
+	return login, nil
+}
+
+// ping checks the Github API can be reached. /rate_limit is used as it does
+// not count against the rate limit.
+func (c *Client) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url("/rate_limit", nil), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("github: unexpected status %d for %s", resp.StatusCode, req.URL.Path)
+	}
+	return nil
+}
+
+// get sends an authenticated GET request to the Github API and decodes the
+// JSON response into v
+func (c *Client) get(ctx context.Context, token, path string, params url.Values, v interface{}) error {
+	_, err := c.fetch(ctx, token, c.url(path, params), v)
+	return err
+}
+
+// getPages follows the Link header of a paginated Github endpoint and
+// collects every page
+func getPages[T any](ctx context.Context, c *Client, token, path string, params url.Values) ([]T, error) {
+	var items []T
+	next := c.url(path, params)
+	for next != "" {
+		var page []T
+		var err error
+		if next, err = c.fetch(ctx, token, next, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+	}
+	return items, nil
+}
+
+// url builds the URL of an API path, below the path of the API base URL
+// as on Github Enterprise
+func (c *Client) url(path string, params url.Values) string {
+	return joinURL(c.apiURL, path, params)
+}
+
+// oauthURL builds the URL of an OAuth path, or any other page, on the
+// Github site
+func (c *Client) oauthURL(path string, params url.Values) string {
+	return joinURL(c.webURL, path, params)
+}
+
+func joinURL(base url.URL, path string, params url.Values) string {
+	base.Path = strings.TrimSuffix(base.Path, "/") + path
+	base.RawQuery = params.Encode()
+	return base.String()
+}
+
+// fetch decodes the response of an authenticated GET request into v and
+// returns the URL of the next page, if any. Responses carrying an ETag are
+// cached so repeated requests can be made conditionally and do not count
+// against the quota. When Github cannot be reached the cached response is
+// used instead. Once ctx is done no request is sent, so paginated and
+// per-commit loops stop at their next call.
+func (c *Client) fetch(ctx context.Context, token, rawURL string, v interface{}) (string, error) {
+	user := userKey(token)
+	key := user + " " + rawURL
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// Wait out an exhausted rate limit before spending another request
+	if err := c.waitForRateLimit(ctx, token); err != nil {
+		return "", err
+	}
 
 	// Create request
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
 	if err != nil {
 		return "", err
 	}
 	req.Header.Add("Authorization", "token "+token)
+	req.Header.Add("Accept", "application/vnd.github.v3+json")
+	cached, hasCache := c.cached(key)
+	if hasCache {
+		req.Header.Add("If-None-Match", cached.etag)
+	}
 
-	// Send request
-	resp, err := http.DefaultClient.Do(req)
+	// Send request. Only the path is logged, the token never is.
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	githubRequestDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		githubRequests.WithLabelValues("error").Inc()
+	} else {
+		githubRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	}
+	if err != nil && hasCache && ctx.Err() == nil {
+		c.log.Warn("github unreachable, serving cached response", "path", req.URL.Path, "error", redactURL(err))
+		return cached.next, json.Unmarshal(cached.body, v)
+	} else if err != nil {
+		c.log.Error("github request failed", "path", req.URL.Path, "duration", time.Since(start), "error", redactURL(err))
 		return "", err
 	}
+	defer resp.Body.Close()
+	c.updateRateLimit(token, resp.Header)
+	c.log.Debug("github request", "path", req.URL.Path, "status", resp.StatusCode, "duration", time.Since(start))
+
+	// Check response status
+	var body []byte
+	next := nextPage(resp.Header)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && hasCache:
+		body, next = cached.body, cached.next
+	case resp.StatusCode == http.StatusOK:
+		if body, err = ioutil.ReadAll(resp.Body); err != nil {
+			return "", err
+		}
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			c.store(cacheEntry{user: user, key: key, etag: etag, body: body, next: next})
+		}
+	default:
+		return "", statusError(resp, req.URL.Path)
+	}
 
 	// Parse response
-	var user User
-	if err = json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return "", err
+	return next, json.Unmarshal(body, v)
+}
+
+// nextPage extracts the rel="next" URL from a Link header
+func nextPage(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) != `rel="next"` {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(parts[0]), "<>")
 	}
+	return ""
+}
 
-	return user.Username, nil
+// waitForRateLimit blocks until the rate limit for a token resets when its
+// budget has been spent. If the reset is too far away ErrRateLimited is
+// returned instead, and ctx's error if it is done first.
+func (c *Client) waitForRateLimit(ctx context.Context, token string) error {
+	c.mu.Lock()
+	limit, ok := c.limits[userKey(token)]
+	c.mu.Unlock()
+	if !ok || limit.remaining > 0 {
+		return nil
+	}
+
+	wait := limit.reset.Sub(time.Now())
+	if wait <= 0 {
+		return nil
+	} else if wait > maxRateLimitWait {
+		return ErrRateLimited
+	}
+	c.log.Info("waiting for github rate limit", "user", userKey(token), "wait", wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (c *Client) postAccessToken(code string) (*accessTokenResponse, error) {
-	// Create URL
-	u := new(url.URL)
-	u.Scheme = "https"
-	u.Host = "github.com"
-	u.Path = "/login/oauth/access_token"
-	params := u.Query()
+func (c *Client) updateRateLimit(token string, header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits[userKey(token)] = rateLimit{
+		remaining: remaining,
+		reset:     time.Unix(reset, 0),
+	}
+
+	// Report the user closest to being rate limited, skipping windows
+	// which have reset since
+	lowest := remaining
+	for _, limit := range c.limits {
+		if limit.reset.After(time.Now()) {
+			lowest = min(lowest, limit.remaining)
+		}
+	}
+	githubRateLimitRemaining.Set(float64(lowest))
+}
+
+func (c *Client) cached(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.cache[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.recent.MoveToFront(elem)
+	return elem.Value.(cacheEntry), true
+}
+
+// store caches a response, dropping the least recently used ones past
+// maxCacheEntries
+func (c *Client) store(entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.cache[entry.key]; ok {
+		elem.Value = entry
+		c.recent.MoveToFront(elem)
+		return
+	}
+	c.cache[entry.key] = c.recent.PushFront(entry)
+	for c.recent.Len() > maxCacheEntries {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.cache, oldest.Value.(cacheEntry).key)
+	}
+}
+
+// forget drops the cached responses, login and rate limit of the user with
+// a userKey, once they are deleted
+func (c *Client) forget(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.recent.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(cacheEntry); entry.user == user {
+			c.recent.Remove(elem)
+			delete(c.cache, entry.key)
+		}
+		elem = next
+	}
+	delete(c.limits, user)
+	delete(c.logins, user)
+}
+
+// statusError maps the status of a failed response to an error
+func statusError(resp *http.Response, path string) error {
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case isRateLimited(resp):
+		return ErrRateLimited
+	default:
+		return fmt.Errorf("github: unexpected status %d for %s", resp.StatusCode, path)
+	}
+}
+
+// isRateLimited reports whether a response was rejected because the rate
+// limit has been exhausted
+func isRateLimited(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	return resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != ""
+}
+
+// postAccessToken exchanges an OAuth code, issued for redirectURI, for a
+// token. The code and client secret are sent in the form encoded body, never
+// in the URL.
+func (c *Client) postAccessToken(ctx context.Context, code, redirectURI string) (*accessTokenResponse, error) {
+	// Create form
+	params := url.Values{}
 	params.Add("client_id", c.secrets["clientID"])
 	params.Add("client_secret", c.secrets["clientSecret"])
 	params.Add("code", code)
-	params.Add("redirect_uri", "http://localhost:9000/login/callback")
+	params.Add("redirect_uri", redirectURI)
 	params.Add("state", c.secrets["githubState"])
-	u.RawQuery = params.Encode()
 
 	// Create request
-	req, err := http.NewRequest("POST", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.oauthURL("/login/oauth/access_token", nil), strings.NewReader(params.Encode()))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	// Send request
-	resp, err := http.DefaultTransport.RoundTrip(req)
-	if err != nil && resp.StatusCode != 302 {
+	// Send request through the transport so redirects are not followed
+	transport := c.http.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	githubRequestDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		githubRequests.WithLabelValues("error").Inc()
+		c.log.Error("github request failed", "path", req.URL.Path, "duration", time.Since(start), "error", redactURL(err))
 		return nil, err
 	}
+	defer resp.Body.Close()
+	githubRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	c.log.Debug("github request", "path", req.URL.Path, "status", resp.StatusCode, "duration", time.Since(start))
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, req.URL.Path)
+	}
 
 	// Parse response
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	params, err = url.ParseQuery(string(body))
 	if err != nil {
 		return nil, err
 	}
+	// Github answers a bad or expired code with an error and no token
+	if params.Get("error") != "" || params.Get("access_token") == "" {
+		return nil, ErrUnauthorized
+	}
 	// Return response
 	return &accessTokenResponse{
 		AccessToken: params.Get("access_token"),
@@ -153,6 +662,15 @@ func (c *Client) postAccessToken(code string) (*accessTokenResponse, error) {
 	}, nil
 }
 
+// splitFullName splits an owner/name repository name
+func splitFullName(fullName string) (owner, name string, ok bool) {
+	parts := strings.Split(fullName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
 type accessTokenResponse struct {
 	AccessToken string `json:"access_token"`
 	Scope       string `json:"scope"`
@@ -161,9 +679,19 @@ type accessTokenResponse struct {
 
 // Repository holds information for a github repository
 type Repository struct {
-	ID     int    `json:"id,omitempty"`
-	Name   string `json:"name"`
-	Active bool   `json:"active,omitempty"`
+	ID            int    `json:"id,omitempty"`
+	Name          string `json:"name"`
+	FullName      string `json:"full_name"`
+	Owner         *User  `json:"owner,omitempty"`
+	Fork          bool   `json:"fork"`
+	Private       bool   `json:"private"`
+	Active        bool   `json:"active"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+}
+
+// Organization holds information for a github organization
+type Organization struct {
+	Login string `json:"login"`
 }
 
 // User holds information for a github user
@@ -171,13 +699,117 @@ type User struct {
 	Username string `json:"login"`
 }
 
-// GitCommit holds Github commits from a specific repository
+// GitCommit holds Github commits from a specific repository. Stats and
+// files are only sent for single commits. Branches, tags and pull requests
+// are not part of the Github response, they are filled in while walking the
+// branches of a repository.
 type GitCommit struct {
-	HTML   string  `json:"html_url"`
-	Commit *Commit `json:"commit"`
+	SHA      string        `json:"sha"`
+	HTML     string        `json:"html_url"`
+	Commit   *Commit       `json:"commit"`
+	Author   *User         `json:"author"`
+	Parents  []*CommitRef  `json:"parents"`
+	Stats    *CommitStats  `json:"stats,omitempty"`
+	Files    []*CommitFile `json:"files,omitempty"`
+	Branches []string      `json:"branches,omitempty"`
+	Tags     []string      `json:"tags,omitempty"`
+
+	PullRequests []*GitPullRequest `json:"pull_requests,omitempty"`
+
+	// issuesURL is the issues page of the repository on the configured
+	// Github site, which referenced issues link to
+	issuesURL string
+}
+
+// CommitStats counts the lines changed by a commit
+type CommitStats struct {
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+}
+
+// CommitFile holds a file changed by a commit and its unified diff
+type CommitFile struct {
+	Filename  string `json:"filename"`
+	Status    string `json:"status"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Patch     string `json:"patch,omitempty"`
 }
 
-// Commit holds the commit message
+// GitPullRequest holds a Github pull request
+type GitPullRequest struct {
+	Number int      `json:"number"`
+	Title  string   `json:"title"`
+	Body   string   `json:"body"`
+	State  string   `json:"state"`
+	HTML   string   `json:"html_url"`
+	User   *User    `json:"user"`
+	Labels []*Label `json:"labels"`
+
+	Head           *CommitRef `json:"head,omitempty"`
+	MergeCommitSHA string     `json:"merge_commit_sha,omitempty"`
+}
+
+// commitSHAs lists the head commit of a pull request and the commit it was
+// merged as, if any
+func (p *GitPullRequest) commitSHAs() []string {
+	var shas []string
+	if p.Head != nil && p.Head.SHA != "" {
+		shas = append(shas, p.Head.SHA)
+	}
+	if p.MergeCommitSHA != "" && (p.Head == nil || p.MergeCommitSHA != p.Head.SHA) {
+		shas = append(shas, p.MergeCommitSHA)
+	}
+	return shas
+}
+
+// GitReviewComment holds a comment left on the diff of a pull request
+type GitReviewComment struct {
+	ID             int64  `json:"id"`
+	Body           string `json:"body"`
+	Path           string `json:"path"`
+	HTML           string `json:"html_url"`
+	User           *User  `json:"user"`
+	PullRequestURL string `json:"pull_request_url"`
+}
+
+// PullRequestNumber parses the number of the pull request a review comment
+// belongs to
+func (c *GitReviewComment) PullRequestNumber() int {
+	i := strings.LastIndex(c.PullRequestURL, "/")
+	number, err := strconv.Atoi(c.PullRequestURL[i+1:])
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+// Label holds a Github issue or pull request label
+type Label struct {
+	Name string `json:"name"`
+}
+
+// CommitRef points at a commit by its sha
+type CommitRef struct {
+	SHA string `json:"sha"`
+}
+
+// Ref holds a branch or a tag and the commit it points at
+type Ref struct {
+	Name   string     `json:"name"`
+	Commit *CommitRef `json:"commit"`
+}
+
+// Commit holds the commit message and who wrote it
 type Commit struct {
-	Message string `json:"message"`
+	Message   string     `json:"message"`
+	Author    *Signature `json:"author"`
+	Committer *Signature `json:"committer"`
+}
+
+// Signature holds the git author or committer of a commit
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
 }
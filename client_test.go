@@ -0,0 +1,286 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amaxwellblair/git_engine/githubtest"
+)
+
+// newTestClient starts a fake Github and a client of it
+func newTestClient(t *testing.T) (*Client, *githubtest.Server) {
+	t.Helper()
+	gh := githubtest.NewServer(nil)
+	t.Cleanup(gh.Close)
+	return NewClient(gh.Secrets(), gh.BaseURL(), gh.BaseURL(), gh.Client(), testLogger), gh
+}
+
+// remaining returns the requests a client knows a token has left
+func remaining(c *Client, token string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limits[userKey(token)].remaining
+}
+
+func TestClientPagination(t *testing.T) {
+	tests := []struct {
+		name         string
+		perPage      int
+		branch       string
+		wantCommits  int
+		wantRequests int
+	}{
+		{"one page", 100, "", 7, 1},
+		{"several pages", 3, "", 7, 3},
+		{"one commit a page", 1, "", 7, 7},
+		{"branch", 3, "feature", 5, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, gh := newTestClient(t)
+			gh.SetPerPage(tt.perPage)
+			commits, err := c.getCommits(context.Background(), githubtest.OctocatToken, "hello-world", "octocat", tt.branch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(commits) != tt.wantCommits {
+				t.Errorf("got %d commits, want %d", len(commits), tt.wantCommits)
+			}
+			if gh.Requests() != tt.wantRequests {
+				t.Errorf("sent %d requests, want %d", gh.Requests(), tt.wantRequests)
+			}
+
+			// Every page is read once, newest commit first
+			seen := make(map[string]bool)
+			for i, commit := range commits {
+				if seen[commit.SHA] {
+					t.Errorf("commit %s listed twice", commit.SHA)
+				}
+				seen[commit.SHA] = true
+				if i > 0 && commit.Commit.Author.Date.After(commits[i-1].Commit.Author.Date) {
+					t.Errorf("commit %s listed after an older one", commit.SHA)
+				}
+			}
+		})
+	}
+}
+
+func TestClientConditionalRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(gh *githubtest.Server) error
+		wantCommits int
+		wantSpent   int
+	}{
+		{
+			name:        "unchanged",
+			change:      func(gh *githubtest.Server) error { return nil },
+			wantCommits: 7,
+			wantSpent:   0,
+		},
+		{
+			name: "new commit",
+			change: func(gh *githubtest.Server) error {
+				return gh.AddCommit("octocat/hello-world", "main", &githubtest.Commit{
+					SHA:     "8888888888888888888888888888888888888888",
+					Message: "Add a farewell",
+					Date:    time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+				})
+			},
+			wantCommits: 8,
+			wantSpent:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, gh := newTestClient(t)
+			first, err := c.getCommits(ctx, githubtest.OctocatToken, "hello-world", "octocat", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.change(gh); err != nil {
+				t.Fatal(err)
+			}
+
+			// Unchanged pages are answered with 304 and the cached body,
+			// which Github does not count against the rate limit
+			before, requests := remaining(c, githubtest.OctocatToken), gh.Requests()
+			second, err := c.getCommits(ctx, githubtest.OctocatToken, "hello-world", "octocat", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(second) != tt.wantCommits {
+				t.Errorf("got %d commits, want %d", len(second), tt.wantCommits)
+			}
+			if spent := before - remaining(c, githubtest.OctocatToken); spent != tt.wantSpent {
+				t.Errorf("spent %d requests, want %d", spent, tt.wantSpent)
+			}
+			if gh.Requests() == requests {
+				t.Error("no conditional request sent")
+			}
+			if tt.wantSpent == 0 && second[0].SHA != first[0].SHA {
+				t.Errorf("cached page starts at %s, want %s", second[0].SHA, first[0].SHA)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		repo    string
+		setup   func(gh *githubtest.Server)
+		wantErr error
+	}{
+		{
+			name:  "rate limit exhausted",
+			token: githubtest.OctocatToken,
+			repo:  "hello-world",
+			setup: func(gh *githubtest.Server) {
+				gh.SetRateLimit(githubtest.OctocatToken, 0, time.Now().Add(time.Hour))
+			},
+			wantErr: ErrRateLimited,
+		},
+		{
+			name:  "rate limit reset",
+			token: githubtest.OctocatToken,
+			repo:  "hello-world",
+			setup: func(gh *githubtest.Server) {
+				gh.SetRateLimit(githubtest.OctocatToken, 0, time.Now().Add(-time.Second))
+			},
+		},
+		{
+			name:    "bad token",
+			token:   "gho_nobody",
+			repo:    "hello-world",
+			wantErr: ErrUnauthorized,
+		},
+		{
+			name:    "missing repository",
+			token:   githubtest.OctocatToken,
+			repo:    "nope",
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "private repository of another user",
+			token:   githubtest.HubotToken,
+			repo:    "secret",
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, gh := newTestClient(t)
+			if tt.setup != nil {
+				tt.setup(gh)
+			}
+			_, err := c.getCommits(ctx, tt.token, tt.repo, "octocat", "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("getCommits() error = %v, want %v", err, tt.wantErr)
+			}
+
+			// Once the limit is known to be spent until far ahead, no
+			// request is sent until it resets
+			if errors.Is(tt.wantErr, ErrRateLimited) {
+				requests := gh.Requests()
+				if _, err := c.getCommits(ctx, tt.token, tt.repo, "octocat", ""); !errors.Is(err, ErrRateLimited) {
+					t.Errorf("second getCommits() error = %v, want %v", err, ErrRateLimited)
+				}
+				if gh.Requests() != requests {
+					t.Errorf("sent %d requests while rate limited", gh.Requests()-requests)
+				}
+			}
+		})
+	}
+}
+
+func TestClientLogin(t *testing.T) {
+	tests := []struct {
+		name         string
+		tokens       []string
+		wantLogins   []string
+		wantRequests int
+	}{
+		{"once per session", []string{githubtest.OctocatToken, githubtest.OctocatToken}, []string{"octocat", "octocat"}, 1},
+		{"each session", []string{githubtest.OctocatToken, githubtest.HubotToken, githubtest.OctocatToken}, []string{"octocat", "hubot", "octocat"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, gh := newTestClient(t)
+			for i, token := range tt.tokens {
+				login, err := c.getLogin(context.Background(), token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if login != tt.wantLogins[i] {
+					t.Errorf("getLogin() = %q, want %q", login, tt.wantLogins[i])
+				}
+			}
+			if gh.Requests() != tt.wantRequests {
+				t.Errorf("sent %d requests, want %d", gh.Requests(), tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestClientBranchCommits(t *testing.T) {
+	c, gh := newTestClient(t)
+	commits, err := c.getBranchCommits(context.Background(), githubtest.OctocatToken, "octocat", "hello-world", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byMessage := make(map[string]*IndexCommit)
+	for _, commit := range commits {
+		byMessage[commit.Commit.Message] = newIndexCommit("octocat/hello-world", commit)
+	}
+
+	// Commits of a pull request link to it, and referenced issues to the
+	// configured Github site
+	for _, message := range []string{"Add README", "Fix typo in greeting (#1)"} {
+		commit := byMessage[message]
+		if commit == nil || len(commit.PullRequests) != 1 || commit.PullRequests[0].Number != 1 {
+			t.Errorf("commit %q = %+v, want it linked to #1", message, commit)
+		}
+	}
+	trim := byMessage["Fixes #3 by trimming whitespace"]
+	want := gh.BaseURL().String() + "/octocat/hello-world/issues/3"
+	if trim == nil || len(trim.Issues) != 1 || trim.Issues[0].URL != want {
+		t.Errorf("issue references = %+v, want one to %s", trim, want)
+	}
+}
+
+func TestClientAccessToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		code    func(gh *githubtest.Server) string
+		wantErr error
+	}{
+		{"valid code", "", func(gh *githubtest.Server) string { return gh.Code("octocat") }, nil},
+		{"bad code", "", func(gh *githubtest.Server) string { return "nope" }, ErrUnauthorized},
+		{"error status", "/nope", func(gh *githubtest.Server) string { return gh.Code("octocat") }, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gh := githubtest.NewServer(nil)
+			t.Cleanup(gh.Close)
+			webURL := gh.BaseURL().JoinPath(tt.path)
+			c := NewClient(gh.Secrets(), gh.BaseURL(), webURL, gh.Client(), testLogger)
+
+			// Failed exchanges are told apart by the status Github answers
+			// with, not only by the body
+			resp, err := c.postAccessToken(context.Background(), tt.code(gh), "http://localhost/callback")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("postAccessToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && resp.AccessToken != githubtest.OctocatToken {
+				t.Errorf("postAccessToken() token = %q, want %q", resp.AccessToken, githubtest.OctocatToken)
+			}
+		})
+	}
+}
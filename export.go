@@ -0,0 +1,218 @@
+package search
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats of commit searches
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+	FormatAtom  = "atom"
+)
+
+// commitExporter writes commits in an export format one at a time, so
+// exports of any size are streamed
+type commitExporter interface {
+	begin() error
+	write(commit *IndexCommit) error
+	end() error
+}
+
+// newCommitExporter sets the response headers of an export format and
+// returns its exporter
+func newCommitExporter(w http.ResponseWriter, format, fullName, feedURL string) (commitExporter, error) {
+	filename := strings.Replace(fullName, "/", "-", -1) + "-commits." + format
+	switch format {
+	case FormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filename))
+		return &csvExporter{w: csv.NewWriter(w)}, nil
+	case FormatJSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filename))
+		return &jsonlExporter{enc: json.NewEncoder(w)}, nil
+	case FormatAtom:
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		return &atomExporter{w: w, title: fullName + " commits", url: feedURL}, nil
+	default:
+		return nil, ErrBadRequest
+	}
+}
+
+// exportWriter records whether an export has started its response, after
+// which errors can no longer be reported to the client
+type exportWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *exportWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
+// exportCommits streams every commit matching a search in an export format
+func (h *Handler) exportCommits(ctx context.Context, w http.ResponseWriter, r *http.Request, fullName string, query *SearchQuery, format string) error {
+	exporter, err := newCommitExporter(w, format, fullName, h.domain+r.URL.RequestURI())
+	if err != nil {
+		return err
+	}
+	if err := exporter.begin(); err != nil {
+		return err
+	}
+	if err := h.store.ScrollCommits(ctx, fullName, query, exporter.write); err != nil {
+		return err
+	}
+	return exporter.end()
+}
+
+// csvExporter writes a header row and a row per commit. Lists are joined
+// with semicolons.
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) begin() error {
+	return e.w.Write([]string{
+		"repository", "sha", "date", "author", "author_login", "message", "html_url",
+		"branches", "tags", "pull_requests", "issues",
+	})
+}
+
+func (e *csvExporter) write(c *IndexCommit) error {
+	var pulls, issues []string
+	for _, pr := range c.PullRequests {
+		pulls = append(pulls, fmt.Sprintf("#%d %s", pr.Number, pr.Title))
+	}
+	for _, issue := range c.Issues {
+		issues = append(issues, "#"+strconv.Itoa(issue.Number))
+	}
+	row := []string{
+		c.Repository, c.SHA, c.Date.Format(time.RFC3339), c.Author, c.AuthorLogin, c.Message, c.URL,
+		strings.Join(c.Branches, ";"), strings.Join(c.Tags, ";"),
+		strings.Join(pulls, ";"), strings.Join(issues, ";"),
+	}
+	for i, cell := range row {
+		row[i] = escapeFormula(cell)
+	}
+	return e.w.Write(row)
+}
+
+// escapeFormula quotes a cell spreadsheets would run as a formula, such as
+// a commit message starting with =, so it is shown as text
+func escapeFormula(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func (e *csvExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlExporter writes every commit as a JSON object on a line of its own
+type jsonlExporter struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlExporter) begin() error { return nil }
+
+func (e *jsonlExporter) write(c *IndexCommit) error { return e.enc.Encode(c) }
+
+func (e *jsonlExporter) end() error { return nil }
+
+// atomExporter writes an Atom feed with an entry per commit. Commits come
+// newest first, so the feed is updated when its first commit was.
+type atomExporter struct {
+	w       io.Writer
+	title   string
+	url     string
+	started bool
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	XMLName xml.Name `xml:"entry"`
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Author  string   `xml:"author>name"`
+	Link    atomLink `xml:"link"`
+	Content string   `xml:"content"`
+}
+
+func (e *atomExporter) begin() error {
+	return nil
+}
+
+func (e *atomExporter) write(c *IndexCommit) error {
+	if !e.started {
+		if err := e.header(c.Date); err != nil {
+			return err
+		}
+	}
+	entry := &atomEntry{
+		ID:      c.URL,
+		Title:   strings.SplitN(c.Message, "\n", 2)[0],
+		Updated: c.Date.Format(time.RFC3339),
+		Author:  c.Author,
+		Link:    atomLink{Href: c.URL},
+		Content: c.Message,
+	}
+	return xml.NewEncoder(e.w).Encode(entry)
+}
+
+func (e *atomExporter) end() error {
+	if !e.started {
+		if err := e.header(time.Now()); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(e.w, "</feed>\n")
+	return err
+}
+
+// header opens the feed once the date of its newest commit is known
+func (e *atomExporter) header(updated time.Time) error {
+	e.started = true
+	if _, err := io.WriteString(e.w, xml.Header+`<feed xmlns="http://www.w3.org/2005/Atom">`); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(e.w)
+	fields := []struct {
+		name  string
+		value interface{}
+	}{
+		{"id", e.url},
+		{"title", e.title},
+		{"updated", updated.Format(time.RFC3339)},
+		{"link", atomLink{Href: e.url, Rel: "self"}},
+	}
+	for _, field := range fields {
+		if err := enc.EncodeElement(field.value, xml.StartElement{Name: xml.Name{Local: field.name}}); err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
@@ -0,0 +1,241 @@
+package githubtest
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+)
+
+// OAuth app and tokens of the default fixtures
+const (
+	ClientID     = "githubtest-client"
+	ClientSecret = "githubtest-secret"
+	State        = "githubtest-state"
+
+	OctocatToken = "gho_octocat"
+	HubotToken   = "gho_hubot"
+)
+
+// Fixtures is the Github data served by a Server
+type Fixtures struct {
+	Users []*User
+	Orgs  []*Org
+	Repos []*Repo
+}
+
+// User is a Github account and the token it signs in with
+type User struct {
+	Login string
+	Token string
+}
+
+// Org is a Github organization. Its members can read its private
+// repositories.
+type Org struct {
+	Login   string
+	Members []string
+}
+
+// Repo is a Github repository. Branches and tags name the sha of the
+// commit they point at. Commits of a branch are listed by walking the
+// parents of its head.
+type Repo struct {
+	ID            int
+	Owner         string
+	Name          string
+	Private       bool
+	Fork          bool
+	DefaultBranch string
+
+	// Collaborators can read the repository besides its owner and the
+	// members of the organization owning it
+	Collaborators []string
+
+	Commits  []*Commit
+	Branches map[string]string
+	Tags     map[string]string
+	Pulls    []*PullRequest
+}
+
+// FullName returns owner/name
+func (r *Repo) FullName() string {
+	return r.Owner + "/" + r.Name
+}
+
+// Commit is a git commit and the Github user who wrote it
+type Commit struct {
+	SHA     string
+	Message string
+	Author  string
+	Email   string
+	Login   string
+	Date    time.Time
+	Parents []string
+	Files   []*File
+}
+
+// File is a file changed by a commit
+type File struct {
+	Filename  string
+	Status    string
+	Additions int
+	Deletions int
+	Patch     string
+}
+
+// PullRequest is a pull request, the commits it holds and the review
+// comments left on its diff
+type PullRequest struct {
+	Number   int
+	Title    string
+	Body     string
+	State    string
+	Author   string
+	Labels   []string
+	Commits  []string
+	Comments []*ReviewComment
+}
+
+// ReviewComment is a comment left on the diff of a pull request
+type ReviewComment struct {
+	ID     int64
+	Body   string
+	Path   string
+	Author string
+}
+
+// DefaultFixtures returns two users, octocat and hubot, and their
+// repositories:
+//
+//   - octocat/hello-world, public, with enough commits on two branches to
+//     span several pages, a tag and a merged pull request with a review
+//     comment
+//   - octocat/secret, private to octocat
+//   - octo-org/tools, private to the members of octo-org, octocat and hubot
+func DefaultFixtures() *Fixtures {
+	start := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	var commits []*Commit
+	parent := ""
+	messages := []string{
+		"Initial commit",
+		"Add README",
+		"Fix typo in greeting (#1)",
+		"Add command line flags",
+		"Refactor greeting into its own package",
+		"Fixes #3 by trimming whitespace",
+		"Bump version to 1.1",
+	}
+	for i, message := range messages {
+		commit := &Commit{
+			SHA:     sha("hello-world", i),
+			Message: message,
+			Author:  "The Octocat",
+			Email:   "octocat@github.com",
+			Login:   "octocat",
+			Date:    start.Add(time.Duration(i) * 24 * time.Hour),
+			Files: []*File{{
+				Filename:  "hello.go",
+				Status:    "modified",
+				Additions: i + 1,
+				Deletions: i,
+				Patch:     fmt.Sprintf("@@ -1,%d +1,%d @@\n-fmt.Println(%d)\n+fmt.Println(%d)", i, i+1, i, i+1),
+			}},
+		}
+		if parent != "" {
+			commit.Parents = []string{parent}
+		}
+		commits = append(commits, commit)
+		parent = commit.SHA
+	}
+	feature := &Commit{
+		SHA:     sha("hello-world", len(messages)),
+		Message: "Experiment with a colourful greeting",
+		Author:  "Hubot",
+		Email:   "hubot@github.com",
+		Login:   "hubot",
+		Date:    start.Add(time.Duration(len(messages)) * 24 * time.Hour),
+		Parents: []string{commits[3].SHA},
+	}
+	commits = append(commits, feature)
+
+	secret := &Commit{
+		SHA:     sha("secret", 0),
+		Message: "Store the launch codes",
+		Author:  "The Octocat",
+		Email:   "octocat@github.com",
+		Login:   "octocat",
+		Date:    start,
+	}
+	tools := &Commit{
+		SHA:     sha("tools", 0),
+		Message: "Add release script",
+		Author:  "Hubot",
+		Email:   "hubot@github.com",
+		Login:   "hubot",
+		Date:    start,
+	}
+
+	return &Fixtures{
+		Users: []*User{
+			{Login: "octocat", Token: OctocatToken},
+			{Login: "hubot", Token: HubotToken},
+		},
+		Orgs: []*Org{
+			{Login: "octo-org", Members: []string{"octocat", "hubot"}},
+		},
+		Repos: []*Repo{
+			{
+				ID:            1296269,
+				Owner:         "octocat",
+				Name:          "hello-world",
+				DefaultBranch: "main",
+				Commits:       commits,
+				Branches: map[string]string{
+					"main":    commits[len(messages)-1].SHA,
+					"feature": feature.SHA,
+				},
+				Tags: map[string]string{
+					"v1.0": commits[4].SHA,
+				},
+				Pulls: []*PullRequest{{
+					Number:  1,
+					Title:   "Fix typo in greeting",
+					Body:    "The greeting said helo.",
+					State:   "closed",
+					Author:  "hubot",
+					Labels:  []string{"bug"},
+					Commits: []string{commits[1].SHA, commits[2].SHA},
+					Comments: []*ReviewComment{{
+						ID:     101,
+						Body:   "Nice catch, thanks!",
+						Path:   "hello.go",
+						Author: "octocat",
+					}},
+				}},
+			},
+			{
+				ID:            1296270,
+				Owner:         "octocat",
+				Name:          "secret",
+				Private:       true,
+				DefaultBranch: "main",
+				Commits:       []*Commit{secret},
+				Branches:      map[string]string{"main": secret.SHA},
+			},
+			{
+				ID:            1296271,
+				Owner:         "octo-org",
+				Name:          "tools",
+				Private:       true,
+				DefaultBranch: "main",
+				Commits:       []*Commit{tools},
+				Branches:      map[string]string{"main": tools.SHA},
+			},
+		},
+	}
+}
+
+// sha derives a stable 40 character sha for the nth commit of a repository
+func sha(repo string, n int) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%s/%d", repo, n))))
+}
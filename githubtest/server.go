@@ -0,0 +1,821 @@
+// Package githubtest serves a fake Github API and OAuth site from fixtures,
+// so the Github client and the handlers using it run without a network.
+//
+//	gh := githubtest.NewServer(nil)
+//	defer gh.Close()
+//	h := search.NewHandler(search.NewMemoryStore(logger), search.Config{
+//		GithubAPI: gh.BaseURL(),
+//		GithubURL: gh.BaseURL(),
+//		Secrets:   gh.Secrets(),
+//		StaticDir: "mitgine/static",
+//	})
+package githubtest
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultRateLimit is the number of requests a token may send per hour,
+// as on Github
+const DefaultRateLimit = 5000
+
+// DefaultPerPage caps the page size of list endpoints, small enough that
+// the default fixtures span several pages
+const DefaultPerPage = 3
+
+// Server is a fake Github serving its API and OAuth endpoints from the same
+// host. Requests are authenticated with the tokens of the fixtures, count
+// against a rate limit, are paginated and answer conditional requests.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	fixtures *Fixtures
+	perPage  int
+	login    string
+	limits   map[string]*rateLimit
+	codes    map[string]grant
+	issued   int
+	requests int
+}
+
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// grant is an OAuth code waiting to be exchanged for a token
+type grant struct {
+	token string
+	scope string
+}
+
+// userKey is the context key of the authenticated user
+type userKey struct{}
+
+// NewServer starts a server serving fixtures, DefaultFixtures() when nil.
+// The first user signs in at /login/oauth/authorize.
+func NewServer(fixtures *Fixtures) *Server {
+	if fixtures == nil {
+		fixtures = DefaultFixtures()
+	}
+	s := &Server{
+		fixtures: fixtures,
+		perPage:  DefaultPerPage,
+		limits:   make(map[string]*rateLimit),
+		codes:    make(map[string]grant),
+	}
+	if len(fixtures.Users) > 0 {
+		s.login = fixtures.Users[0].Login
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/login/oauth/authorize", s.getAuthorizeHandler).
+		Methods("GET")
+	r.HandleFunc("/login/oauth/access_token", s.postAccessTokenHandler).
+		Methods("POST")
+	r.HandleFunc("/rate_limit", s.getRateLimitHandler).
+		Methods("GET")
+
+	api := r.NewRoute().Subrouter()
+	api.Use(s.authenticate)
+	api.HandleFunc("/user", s.getUserHandler).
+		Methods("GET")
+	api.HandleFunc("/user/repos", s.getUserReposHandler).
+		Methods("GET")
+	api.HandleFunc("/user/orgs", s.getUserOrgsHandler).
+		Methods("GET")
+	api.HandleFunc("/orgs/{org}/repos", s.getOrgReposHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}", s.getRepoHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/commits", s.getCommitsHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/commits/{ref}", s.getCommitHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/commits/{ref}/pulls", s.getCommitPullsHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/pulls", s.getPullsHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/pulls/comments", s.getReviewCommentsHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/pulls/{number:[0-9]+}/commits", s.getPullCommitsHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/branches", s.getBranchesHandler).
+		Methods("GET")
+	api.HandleFunc("/repos/{owner}/{name}/tags", s.getTagsHandler).
+		Methods("GET")
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMessage(w, http.StatusNotFound, "Not Found")
+	})
+
+	s.Server = httptest.NewServer(r)
+	return s
+}
+
+// BaseURL returns the URL of the server, to be used as both the Github API
+// and the Github site
+func (s *Server) BaseURL() *url.URL {
+	u, _ := url.Parse(s.URL)
+	return u
+}
+
+// Secrets returns the clientID, clientSecret and githubState of the OAuth
+// app the server accepts
+func (s *Server) Secrets() map[string]string {
+	return map[string]string{
+		"clientID":     ClientID,
+		"clientSecret": ClientSecret,
+		"githubState":  State,
+	}
+}
+
+// SetPerPage caps the page size of list endpoints
+func (s *Server) SetPerPage(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.perPage = n
+}
+
+// SetLogin chooses the user signing in at /login/oauth/authorize
+func (s *Server) SetLogin(login string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.login = login
+}
+
+// SetRateLimit sets the requests a token has left until reset
+func (s *Server) SetRateLimit(token string, remaining int, reset time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits[token] = &rateLimit{remaining: remaining, reset: reset}
+}
+
+// Code issues an OAuth code for a user, as if they had approved the app
+func (s *Server) Code(login string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.userByLogin(login)
+	if user == nil {
+		return ""
+	}
+	return s.issueCode(user.Token, "public_repo")
+}
+
+// Requests returns the number of API requests received
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// AddCommit pushes a commit onto a branch of a repository. A commit
+// without parents gets the head of the branch as its parent.
+func (s *Server) AddCommit(fullName, branch string, commit *Commit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo := s.repoByName(fullName)
+	if repo == nil {
+		return fmt.Errorf("githubtest: no repository %s", fullName)
+	}
+	if head, ok := repo.Branches[branch]; ok && len(commit.Parents) == 0 {
+		commit.Parents = []string{head}
+	}
+	if repo.Branches == nil {
+		repo.Branches = make(map[string]string)
+	}
+	repo.Commits = append(repo.Commits, commit)
+	repo.Branches[branch] = commit.SHA
+	return nil
+}
+
+func (s *Server) getAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the app
+	params := r.URL.Query()
+	if params.Get("client_id") != ClientID {
+		writeMessage(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	redirect, err := url.Parse(params.Get("redirect_uri"))
+	if err != nil || redirect.String() == "" {
+		writeMessage(w, http.StatusBadRequest, "redirect_uri is required")
+		return
+	}
+
+	// Approve the app as the signed in user
+	s.mu.Lock()
+	user := s.userByLogin(s.login)
+	var code string
+	if user != nil {
+		code = s.issueCode(user.Token, params.Get("scope"))
+	}
+	s.mu.Unlock()
+	if user == nil {
+		writeMessage(w, http.StatusUnauthorized, "No user signed in")
+		return
+	}
+
+	// Send the user back to the app
+	query := redirect.Query()
+	query.Set("code", code)
+	query.Set("state", params.Get("state"))
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// postAccessTokenHandler exchanges an OAuth code for a token. Like Github,
+// failures are answered with 200 and an error in the form encoded body.
+func (s *Server) postAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	values := url.Values{}
+	s.mu.Lock()
+	g, ok := s.codes[r.Form.Get("code")]
+	delete(s.codes, r.Form.Get("code"))
+	s.mu.Unlock()
+	switch {
+	case r.Form.Get("client_id") != ClientID || r.Form.Get("client_secret") != ClientSecret:
+		values.Set("error", "incorrect_client_credentials")
+	case !ok:
+		values.Set("error", "bad_verification_code")
+	default:
+		values.Set("access_token", g.token)
+		values.Set("scope", g.scope)
+		values.Set("token_type", "bearer")
+	}
+	w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+	fmt.Fprint(w, values.Encode())
+}
+
+func (s *Server) getRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"resources": map[string]interface{}{
+			"core": map[string]interface{}{"limit": DefaultRateLimit},
+		},
+	})
+}
+
+// authenticate finds the user of the token of a request and rejects it
+// once the token's rate limit is spent
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(strings.TrimPrefix(auth, "token "), "Bearer ")
+
+		s.mu.Lock()
+		s.requests++
+		var user *User
+		for _, u := range s.fixtures.Users {
+			if auth != "" && u.Token == token {
+				user = u
+			}
+		}
+		var limit *rateLimit
+		if user != nil {
+			limit = s.rateLimit(token)
+			setRateLimitHeaders(w, limit)
+		}
+		s.mu.Unlock()
+
+		if user == nil {
+			writeMessage(w, http.StatusUnauthorized, "Bad credentials")
+			return
+		} else if limit.remaining <= 0 {
+			writeMessage(w, http.StatusForbidden, "API rate limit exceeded for user "+user.Login)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+func (s *Server) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	s.writeJSON(w, r, userJSON(user.Login))
+}
+
+func (s *Server) getUserReposHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	s.mu.Lock()
+	var repos []interface{}
+	for _, repo := range s.fixtures.Repos {
+		if repo.Owner == user.Login || contains(repo.Collaborators, user.Login) || s.isMember(repo.Owner, user.Login) {
+			repos = append(repos, s.repoJSON(repo))
+		}
+	}
+	s.mu.Unlock()
+	s.writePage(w, r, repos)
+}
+
+func (s *Server) getUserOrgsHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	s.mu.Lock()
+	var orgs []interface{}
+	for _, org := range s.fixtures.Orgs {
+		if contains(org.Members, user.Login) {
+			orgs = append(orgs, userJSON(org.Login))
+		}
+	}
+	s.mu.Unlock()
+	s.writePage(w, r, orgs)
+}
+
+func (s *Server) getOrgReposHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	login := mux.Vars(r)["org"]
+	s.mu.Lock()
+	found := false
+	for _, org := range s.fixtures.Orgs {
+		found = found || org.Login == login
+	}
+	var repos []interface{}
+	for _, repo := range s.fixtures.Repos {
+		if repo.Owner == login && s.canRead(user, repo) {
+			repos = append(repos, s.repoJSON(repo))
+		}
+	}
+	s.mu.Unlock()
+	if !found {
+		s.writeNotFound(w, r)
+		return
+	}
+	s.writePage(w, r, repos)
+}
+
+func (s *Server) getRepoHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepo(w, r, func(repo *Repo) (interface{}, bool) {
+		return s.repoJSON(repo), true
+	})
+}
+
+// getCommitsHandler lists the commits reachable from a branch or sha,
+// newest first
+func (s *Server) getCommitsHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepoList(w, r, func(repo *Repo) ([]interface{}, bool) {
+		ref := r.URL.Query().Get("sha")
+		if ref == "" {
+			ref = repo.DefaultBranch
+		}
+		head := resolve(repo, ref)
+		if head == nil {
+			return nil, false
+		}
+
+		// Walk every parent of the head once
+		var reachable []*Commit
+		seen := map[string]bool{head.SHA: true}
+		pending := []*Commit{head}
+		for len(pending) > 0 {
+			commit := pending[0]
+			pending = pending[1:]
+			reachable = append(reachable, commit)
+			for _, parent := range commit.Parents {
+				if c := commitBySHA(repo, parent); c != nil && !seen[parent] {
+					seen[parent] = true
+					pending = append(pending, c)
+				}
+			}
+		}
+		sort.SliceStable(reachable, func(i, j int) bool { return reachable[i].Date.After(reachable[j].Date) })
+
+		commits := make([]interface{}, len(reachable))
+		for i, commit := range reachable {
+			commits[i] = s.commitJSON(repo, commit, false)
+		}
+		return commits, true
+	})
+}
+
+func (s *Server) getCommitHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepo(w, r, func(repo *Repo) (interface{}, bool) {
+		commit := resolve(repo, mux.Vars(r)["ref"])
+		if commit == nil {
+			return nil, false
+		}
+		return s.commitJSON(repo, commit, true), true
+	})
+}
+
+func (s *Server) getCommitPullsHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepoList(w, r, func(repo *Repo) ([]interface{}, bool) {
+		commit := resolve(repo, mux.Vars(r)["ref"])
+		if commit == nil {
+			return nil, false
+		}
+		var pulls []interface{}
+		for _, pull := range repo.Pulls {
+			if contains(pull.Commits, commit.SHA) {
+				pulls = append(pulls, s.pullJSON(repo, pull))
+			}
+		}
+		return pulls, true
+	})
+}
+
+func (s *Server) getPullsHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepoList(w, r, func(repo *Repo) ([]interface{}, bool) {
+		state := r.URL.Query().Get("state")
+		if state == "" {
+			state = "open"
+		}
+		var pulls []interface{}
+		for _, pull := range repo.Pulls {
+			if state == "all" || pull.State == state {
+				pulls = append(pulls, s.pullJSON(repo, pull))
+			}
+		}
+		return pulls, true
+	})
+}
+
+func (s *Server) getPullCommitsHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepoList(w, r, func(repo *Repo) ([]interface{}, bool) {
+		number, _ := strconv.Atoi(mux.Vars(r)["number"])
+		for _, pull := range repo.Pulls {
+			if pull.Number != number {
+				continue
+			}
+			commits := []interface{}{}
+			for _, sha := range pull.Commits {
+				if commit := commitBySHA(repo, sha); commit != nil {
+					commits = append(commits, s.commitJSON(repo, commit, false))
+				}
+			}
+			return commits, true
+		}
+		return nil, false
+	})
+}
+
+func (s *Server) getReviewCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepoList(w, r, func(repo *Repo) ([]interface{}, bool) {
+		var comments []interface{}
+		for _, pull := range repo.Pulls {
+			for _, comment := range pull.Comments {
+				comments = append(comments, s.reviewCommentJSON(repo, pull, comment))
+			}
+		}
+		return comments, true
+	})
+}
+
+func (s *Server) getBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepoList(w, r, func(repo *Repo) ([]interface{}, bool) {
+		return refsJSON(repo.Branches), true
+	})
+}
+
+func (s *Server) getTagsHandler(w http.ResponseWriter, r *http.Request) {
+	s.withRepoList(w, r, func(repo *Repo) ([]interface{}, bool) {
+		return refsJSON(repo.Tags), true
+	})
+}
+
+// withRepo answers with the object built from the repository of a request,
+// or 404 when the repository or the object does not exist or the user
+// cannot read it
+func (s *Server) withRepo(w http.ResponseWriter, r *http.Request, build func(*Repo) (interface{}, bool)) {
+	args := mux.Vars(r)
+	s.mu.Lock()
+	repo := s.repoByName(args["owner"] + "/" + args["name"])
+	var v interface{}
+	ok := repo != nil && s.canRead(currentUser(r), repo)
+	if ok {
+		v, ok = build(repo)
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.writeNotFound(w, r)
+		return
+	}
+	s.writeJSON(w, r, v)
+}
+
+// withRepoList answers with a page of the list built from the repository
+// of a request
+func (s *Server) withRepoList(w http.ResponseWriter, r *http.Request, build func(*Repo) ([]interface{}, bool)) {
+	args := mux.Vars(r)
+	s.mu.Lock()
+	repo := s.repoByName(args["owner"] + "/" + args["name"])
+	var items []interface{}
+	ok := repo != nil && s.canRead(currentUser(r), repo)
+	if ok {
+		items, ok = build(repo)
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.writeNotFound(w, r)
+		return
+	}
+	s.writePage(w, r, items)
+}
+
+// writePage answers with the page of items asked for by the page and
+// per_page parameters, linking to the next and last pages
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, items []interface{}) {
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	s.mu.Lock()
+	perPage := s.perPage
+	s.mu.Unlock()
+	if n, err := strconv.Atoi(query.Get("per_page")); err == nil && n > 0 && (perPage <= 0 || n < perPage) {
+		perPage = n
+	}
+	if perPage <= 0 {
+		perPage = 30
+	}
+
+	// Link to the following pages as Github does
+	last := (len(items) + perPage - 1) / perPage
+	if page < last {
+		link := func(n int, rel string) string {
+			query.Set("page", strconv.Itoa(n))
+			return fmt.Sprintf(`<%s%s?%s>; rel="%s"`, s.URL, r.URL.Path, query.Encode(), rel)
+		}
+		w.Header().Set("Link", link(page+1, "next")+", "+link(last, "last"))
+	}
+
+	start := (page - 1) * perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + perPage
+	if end > len(items) {
+		end = len(items)
+	}
+	s.writeJSON(w, r, append([]interface{}{}, items[start:end]...))
+}
+
+// writeJSON answers with v and its ETag. Conditional requests for an
+// unchanged v are answered with 304 and, like on Github, are free.
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(body))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.spend(w, r)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+func (s *Server) writeNotFound(w http.ResponseWriter, r *http.Request) {
+	s.spend(w, r)
+	writeMessage(w, http.StatusNotFound, "Not Found")
+}
+
+// spend counts a request against the rate limit of its token
+func (s *Server) spend(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit := s.rateLimit(currentUser(r).Token)
+	limit.remaining--
+	setRateLimitHeaders(w, limit)
+}
+
+// rateLimit returns the rate limit of a token, refilled once reset has
+// passed. Callers hold s.mu.
+func (s *Server) rateLimit(token string) *rateLimit {
+	limit, ok := s.limits[token]
+	if !ok || !time.Now().Before(limit.reset) {
+		limit = &rateLimit{remaining: DefaultRateLimit, reset: time.Now().Add(time.Hour)}
+		s.limits[token] = limit
+	}
+	return limit
+}
+
+// issueCode creates a single use OAuth code. Callers hold s.mu.
+func (s *Server) issueCode(token, scope string) string {
+	s.issued++
+	code := fmt.Sprintf("code-%d", s.issued)
+	s.codes[code] = grant{token: token, scope: scope}
+	return code
+}
+
+// canRead checks if a user can read a repository. Callers hold s.mu.
+func (s *Server) canRead(user *User, repo *Repo) bool {
+	return !repo.Private ||
+		repo.Owner == user.Login ||
+		contains(repo.Collaborators, user.Login) ||
+		s.isMember(repo.Owner, user.Login)
+}
+
+func (s *Server) isMember(org, login string) bool {
+	for _, o := range s.fixtures.Orgs {
+		if o.Login == org && contains(o.Members, login) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) userByLogin(login string) *User {
+	for _, user := range s.fixtures.Users {
+		if user.Login == login {
+			return user
+		}
+	}
+	return nil
+}
+
+func (s *Server) repoByName(fullName string) *Repo {
+	for _, repo := range s.fixtures.Repos {
+		if strings.EqualFold(repo.FullName(), fullName) {
+			return repo
+		}
+	}
+	return nil
+}
+
+func (s *Server) repoJSON(repo *Repo) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             repo.ID,
+		"name":           repo.Name,
+		"full_name":      repo.FullName(),
+		"owner":          userJSON(repo.Owner),
+		"private":        repo.Private,
+		"fork":           repo.Fork,
+		"default_branch": repo.DefaultBranch,
+		"html_url":       s.URL + "/" + repo.FullName(),
+		"url":            s.URL + "/repos/" + repo.FullName(),
+	}
+}
+
+// commitJSON describes a commit, with its stats and files when it is
+// fetched on its own
+func (s *Server) commitJSON(repo *Repo, commit *Commit, detail bool) map[string]interface{} {
+	signature := map[string]interface{}{
+		"name":  commit.Author,
+		"email": commit.Email,
+		"date":  commit.Date.UTC().Format(time.RFC3339),
+	}
+	parents := []interface{}{}
+	for _, sha := range commit.Parents {
+		parents = append(parents, map[string]interface{}{"sha": sha})
+	}
+	v := map[string]interface{}{
+		"sha":      commit.SHA,
+		"html_url": s.URL + "/" + repo.FullName() + "/commit/" + commit.SHA,
+		"commit": map[string]interface{}{
+			"message":   commit.Message,
+			"author":    signature,
+			"committer": signature,
+		},
+		"author":  nil,
+		"parents": parents,
+	}
+	if commit.Login != "" {
+		v["author"] = userJSON(commit.Login)
+	}
+	if detail {
+		files := []interface{}{}
+		additions, deletions := 0, 0
+		for _, file := range commit.Files {
+			additions += file.Additions
+			deletions += file.Deletions
+			files = append(files, map[string]interface{}{
+				"filename":  file.Filename,
+				"status":    file.Status,
+				"additions": file.Additions,
+				"deletions": file.Deletions,
+				"patch":     file.Patch,
+			})
+		}
+		v["stats"] = map[string]interface{}{
+			"additions": additions,
+			"deletions": deletions,
+			"total":     additions + deletions,
+		}
+		v["files"] = files
+	}
+	return v
+}
+
+func (s *Server) pullJSON(repo *Repo, pull *PullRequest) map[string]interface{} {
+	labels := []interface{}{}
+	for _, label := range pull.Labels {
+		labels = append(labels, map[string]interface{}{"name": label})
+	}
+	v := map[string]interface{}{
+		"number":   pull.Number,
+		"title":    pull.Title,
+		"body":     pull.Body,
+		"state":    pull.State,
+		"html_url": fmt.Sprintf("%s/%s/pull/%d", s.URL, repo.FullName(), pull.Number),
+		"user":     userJSON(pull.Author),
+		"labels":   labels,
+	}
+	// The last commit heads the pull request
+	if len(pull.Commits) > 0 {
+		v["head"] = map[string]interface{}{"sha": pull.Commits[len(pull.Commits)-1]}
+	}
+	return v
+}
+
+func (s *Server) reviewCommentJSON(repo *Repo, pull *PullRequest, comment *ReviewComment) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               comment.ID,
+		"body":             comment.Body,
+		"path":             comment.Path,
+		"html_url":         fmt.Sprintf("%s/%s/pull/%d#discussion_r%d", s.URL, repo.FullName(), pull.Number, comment.ID),
+		"user":             userJSON(comment.Author),
+		"pull_request_url": fmt.Sprintf("%s/repos/%s/pulls/%d", s.URL, repo.FullName(), pull.Number),
+	}
+}
+
+// refsJSON lists branches or tags by name
+func refsJSON(refs map[string]string) []interface{} {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []interface{}{}
+	for _, name := range names {
+		list = append(list, map[string]interface{}{
+			"name":   name,
+			"commit": map[string]interface{}{"sha": refs[name]},
+		})
+	}
+	return list
+}
+
+func userJSON(login string) map[string]interface{} {
+	return map[string]interface{}{"login": login}
+}
+
+// resolve finds the commit a branch, tag or sha points at
+func resolve(repo *Repo, ref string) *Commit {
+	if sha, ok := repo.Branches[ref]; ok {
+		ref = sha
+	} else if sha, ok := repo.Tags[ref]; ok {
+		ref = sha
+	}
+	return commitBySHA(repo, ref)
+}
+
+func commitBySHA(repo *Repo, sha string) *Commit {
+	for _, commit := range repo.Commits {
+		if commit.SHA == sha {
+			return commit
+		}
+	}
+	return nil
+}
+
+func currentUser(r *http.Request) *User {
+	return r.Context().Value(userKey{}).(*User)
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit *rateLimit) {
+	remaining := limit.remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(DefaultRateLimit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(limit.reset.Unix(), 10))
+}
+
+// writeMessage answers with an error body shaped like Github's
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":           message,
+		"documentation_url": "https://docs.github.com/rest",
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
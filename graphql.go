@@ -0,0 +1,662 @@
+package search
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+const (
+	// defaultPageSize is the number of edges returned when first is not set
+	defaultPageSize = 20
+
+	// maxPageSize is the largest page a connection returns
+	maxPageSize = 100
+
+	// cursorPrefix marks the offsets encoded in cursors
+	cursorPrefix = "offset:"
+
+	// maxAuthorCommits is the number of matching commits counted for
+	// authors, so a query of many repositories stays bounded
+	maxAuthorCommits = 10000
+)
+
+// errStopScroll ends a scroll once enough commits are read
+var errStopScroll = errors.New("scroll stopped")
+
+// tokenKey is the context key of the Github token of a GraphQL request
+type tokenKey struct{}
+
+// graphQLRequest is the body of a GraphQL request
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// connection is a page of a list, following the Relay cursor connections
+// specification
+type connection struct {
+	Edges    []*edge   `json:"edges"`
+	PageInfo *pageInfo `json:"pageInfo"`
+}
+
+type edge struct {
+	Cursor string      `json:"cursor"`
+	Node   interface{} `json:"node"`
+}
+
+type pageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+// commitAuthor is the author of an indexed commit
+type commitAuthor struct {
+	Name    string `json:"name"`
+	Login   string `json:"login"`
+	Commits int    `json:"commits"`
+}
+
+// registerGraphQL adds the GraphQL endpoint to a router
+func (h *Handler) registerGraphQL(r *mux.Router) {
+	schema, err := h.graphQLSchema()
+	if err != nil {
+		panic(err)
+	}
+	h.schema = schema
+	r.HandleFunc("/graphql", h.graphQLHandler).
+		Methods("GET", "POST")
+}
+
+func (h *Handler) graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse request
+	var req graphQLRequest
+	if r.Method == "GET" {
+		params := r.URL.Query()
+		req.Query = params.Get("query")
+		req.OperationName = params.Get("operationName")
+		if v := params.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeError(w, r, ErrBadRequest)
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	if req.Query == "" {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	if event := auditEvent(r.Context()); event != nil {
+		event.Query = req.Query
+	}
+
+	// Run the query on behalf of the user
+	result := graphql.Do(graphql.Params{
+		Schema:         h.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(r.Context(), tokenKey{}, token),
+	})
+
+	// Tag resolver errors with the codes of the REST API and hide internal
+	// errors, as writeError does
+	for i, formatted := range result.Errors {
+		gqlErr, ok := formatted.OriginalError().(*gqlerrors.Error)
+		if !ok || gqlErr.OriginalError == nil {
+			continue
+		}
+		status, code := errorStatus(gqlErr.OriginalError)
+		result.Errors[i].Extensions = map[string]interface{}{"code": code}
+		if status >= http.StatusInternalServerError {
+			requestLogger(r.Context()).Error("resolver failed", "path", formatted.Path, "error", gqlErr.OriginalError)
+			result.Errors[i].Message = http.StatusText(status)
+		}
+	}
+
+	// Send the result, errors included, as the GraphQL spec asks
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// graphQLSchema builds the schema served at /graphql
+func (h *Handler) graphQLSchema() (graphql.Schema, error) {
+	owner := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"login": &graphql.Field{Type: graphql.String},
+		},
+	})
+	author := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Author",
+		Description: "The author of commits",
+		Fields: graphql.Fields{
+			"name":    &graphql.Field{Type: graphql.String},
+			"login":   &graphql.Field{Type: graphql.String},
+			"commits": &graphql.Field{Type: graphql.Int, Description: "Number of commits, only counted in facets"},
+		},
+	})
+	pullRequest := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PullRequest",
+		Fields: graphql.Fields{
+			"number": &graphql.Field{Type: graphql.Int},
+			"title":  &graphql.Field{Type: graphql.String},
+			"state":  &graphql.Field{Type: graphql.String},
+			"labels": &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"url":    &graphql.Field{Type: graphql.String},
+		},
+	})
+	issue := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Issue",
+		Fields: graphql.Fields{
+			"number": &graphql.Field{Type: graphql.Int},
+			"closes": &graphql.Field{Type: graphql.Boolean},
+			"url":    &graphql.Field{Type: graphql.String},
+		},
+	})
+	file := graphql.NewObject(graphql.ObjectConfig{
+		Name: "File",
+		Fields: graphql.Fields{
+			"filename":  &graphql.Field{Type: graphql.String},
+			"status":    &graphql.Field{Type: graphql.String},
+			"additions": &graphql.Field{Type: graphql.Int},
+			"deletions": &graphql.Field{Type: graphql.Int},
+			"patch":     &graphql.Field{Type: graphql.String},
+		},
+	})
+	detail := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "CommitDetail",
+		Description: "The stats and diff of a commit",
+		Fields: graphql.Fields{
+			"sha":         &graphql.Field{Type: graphql.String},
+			"message":     &graphql.Field{Type: graphql.String},
+			"url":         &graphql.Field{Type: graphql.String},
+			"date":        &graphql.Field{Type: graphql.DateTime},
+			"author":      &graphql.Field{Type: author, Resolve: resolveAuthor},
+			"authorEmail": &graphql.Field{Type: graphql.String},
+			"parents":     &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"additions":   &graphql.Field{Type: graphql.Int},
+			"deletions":   &graphql.Field{Type: graphql.Int},
+			"files":       &graphql.Field{Type: graphql.NewList(file)},
+		},
+	})
+	commit := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Commit",
+		Fields: graphql.Fields{
+			"repository":   &graphql.Field{Type: graphql.String},
+			"sha":          &graphql.Field{Type: graphql.String},
+			"message":      &graphql.Field{Type: graphql.String},
+			"url":          &graphql.Field{Type: graphql.String},
+			"date":         &graphql.Field{Type: graphql.DateTime},
+			"author":       &graphql.Field{Type: author, Resolve: resolveAuthor},
+			"branches":     &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"tags":         &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"pullRequests": &graphql.Field{Type: graphql.NewList(pullRequest)},
+			"issues":       &graphql.Field{Type: graphql.NewList(issue)},
+			"detail": &graphql.Field{
+				Type:        detail,
+				Description: "Stats and diff of the commit if already stored, use the commit query of a repository to fetch it",
+				Resolve:     h.resolveCommitDetail,
+			},
+		},
+	})
+	document := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "PullRequestDocument",
+		Description: "An indexed pull request or review comment",
+		Fields: graphql.Fields{
+			"type":   &graphql.Field{Type: graphql.String},
+			"number": &graphql.Field{Type: graphql.Int},
+			"title":  &graphql.Field{Type: graphql.String},
+			"body":   &graphql.Field{Type: graphql.String},
+			"state":  &graphql.Field{Type: graphql.String},
+			"labels": &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"author": &graphql.Field{Type: graphql.String},
+			"path":   &graphql.Field{Type: graphql.String},
+			"url":    &graphql.Field{Type: graphql.String},
+		},
+	})
+	result := graphql.NewUnion(graphql.UnionConfig{
+		Name:  "SearchResult",
+		Types: []*graphql.Object{commit, document},
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			if _, ok := p.Value.(*IndexCommit); ok {
+				return commit
+			}
+			return document
+		},
+	})
+	repository := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Repository",
+		Fields: graphql.Fields{
+			"name":          &graphql.Field{Type: graphql.String},
+			"fullName":      &graphql.Field{Type: graphql.String},
+			"owner":         &graphql.Field{Type: owner},
+			"private":       &graphql.Field{Type: graphql.Boolean},
+			"fork":          &graphql.Field{Type: graphql.Boolean},
+			"active":        &graphql.Field{Type: graphql.Boolean},
+			"defaultBranch": &graphql.Field{Type: graphql.String},
+			"branches": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Indexed branches, none meaning the default branch",
+				Resolve:     h.resolveBranches,
+			},
+			"commits": &graphql.Field{
+				Type:        newConnection("Commit", commit),
+				Description: "Commits matching a search, newest first",
+				Args:        pageArgs(searchArgs()),
+				Resolve:     h.resolveCommits,
+			},
+			"commit": &graphql.Field{
+				Type:    detail,
+				Args:    graphql.FieldConfigArgument{"sha": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: h.resolveCommit,
+			},
+			"authors": &graphql.Field{
+				Type:        graphql.NewList(author),
+				Description: "Authors of the newest commits matching a search, most commits first",
+				Args: searchArgs(graphql.FieldConfigArgument{
+					"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPageSize},
+				}),
+				Resolve: h.resolveAuthors,
+			},
+		},
+	})
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"viewer": &graphql.Field{
+				Type:    owner,
+				Resolve: h.resolveViewer,
+			},
+			"repositories": &graphql.Field{
+				Type:        newConnection("Repository", repository),
+				Description: "Active repositories, or repositories starting with query",
+				Args: pageArgs(graphql.FieldConfigArgument{
+					"query": &graphql.ArgumentConfig{Type: graphql.String},
+				}),
+				Resolve: h.resolveRepositories,
+			},
+			"repository": &graphql.Field{
+				Type: repository,
+				Args: graphql.FieldConfigArgument{
+					"owner": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"name":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: h.resolveRepository,
+			},
+			"search": &graphql.Field{
+				Type:        newConnection("SearchResult", result),
+				Description: "Commits, then pull requests and review comments, matching a search in a repository",
+				Args: pageArgs(searchArgs(graphql.FieldConfigArgument{
+					"repository": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"type":       &graphql.ArgumentConfig{Type: graphql.String},
+				})),
+				Resolve: h.resolveSearch,
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// newConnection creates the connection type of a node type
+func newConnection(name string, node graphql.Output) *graphql.Object {
+	edge := graphql.NewObject(graphql.ObjectConfig{
+		Name: name + "Edge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.String},
+			"node":   &graphql.Field{Type: node},
+		},
+	})
+	info := graphql.NewObject(graphql.ObjectConfig{
+		Name: name + "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{Type: graphql.Boolean},
+			"endCursor":   &graphql.Field{Type: graphql.String},
+		},
+	})
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: name + "Connection",
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewList(edge)},
+			"pageInfo": &graphql.Field{Type: info},
+		},
+	})
+}
+
+// pageArgs adds the first and after arguments of connections
+func pageArgs(args graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+	args["first"] = &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPageSize}
+	args["after"] = &graphql.ArgumentConfig{Type: graphql.String}
+	return args
+}
+
+// searchArgs adds the arguments of commit searches
+func searchArgs(args ...graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+	all := graphql.FieldConfigArgument{}
+	for _, a := range args {
+		for name, arg := range a {
+			all[name] = arg
+		}
+	}
+	all["query"] = &graphql.ArgumentConfig{Type: graphql.String}
+	all["branch"] = &graphql.ArgumentConfig{Type: graphql.String}
+	all["tag"] = &graphql.ArgumentConfig{Type: graphql.String}
+	return all
+}
+
+func (h *Handler) resolveViewer(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	login, err := h.client.getUsername(ctx, graphQLToken(p))
+	if err != nil {
+		return nil, err
+	}
+	return &User{Username: login}, nil
+}
+
+func (h *Handler) resolveRepositories(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	first, offset, err := page(p)
+	if err != nil {
+		return nil, err
+	}
+	query, _ := p.Args["query"].(string)
+	repos, err := h.readableRepositories(ctx, graphQLToken(p), query)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []interface{}{}
+	for _, repo := range repos {
+		nodes = append(nodes, repo)
+	}
+	return pageOf(nodes, offset, first), nil
+}
+
+func (h *Handler) resolveRepository(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	token := graphQLToken(p)
+	fullName := p.Args["owner"].(string) + "/" + p.Args["name"].(string)
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		return nil, err
+	}
+
+	// Workspace members may read repositories missing from their own list
+	repo, err := h.store.GetRepository(ctx, token, fullName)
+	if errors.Is(err, ErrRepoNotFound) {
+		return &Repository{
+			Name:     p.Args["name"].(string),
+			FullName: fullName,
+			Owner:    &User{Username: p.Args["owner"].(string)},
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (h *Handler) resolveBranches(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	return h.store.GetBranches(ctx, p.Source.(*Repository).FullName)
+}
+
+func (h *Handler) resolveCommits(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	first, offset, err := page(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Scroll one commit past the page to know whether another follows
+	nodes := []interface{}{}
+	seen := 0
+	err = h.store.ScrollCommits(ctx, p.Source.(*Repository).FullName, graphQLSearch(p), func(c *IndexCommit) error {
+		if seen++; seen <= offset {
+			return nil
+		}
+		nodes = append(nodes, c)
+		if len(nodes) > first {
+			return errStopScroll
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScroll) {
+		return nil, err
+	}
+	return pageOf(nodes, 0, first).shift(offset), nil
+}
+
+func (h *Handler) resolveCommit(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	repo := p.Source.(*Repository)
+	sha := p.Args["sha"].(string)
+	if !shaPattern.MatchString(sha) {
+		return nil, ErrBadRequest
+	}
+	owner, name, _ := splitFullName(repo.FullName)
+	return h.commitDetail(ctx, graphQLToken(p), owner, name, sha)
+}
+
+// resolveCommitDetail only reads stored details, as a page of commits would
+// otherwise send a Github request for each of them
+func (h *Handler) resolveCommitDetail(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	c := p.Source.(*IndexCommit)
+	detail, err := h.store.GetCommitDetail(ctx, c.Repository, c.SHA)
+	if errors.Is(err, ErrCommitNotFound) {
+		return nil, nil
+	}
+	return detail, err
+}
+
+func (h *Handler) resolveAuthors(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	first, _ := p.Args["first"].(int)
+	if first <= 0 || first > maxPageSize {
+		first = maxPageSize
+	}
+
+	// Count the commits of each author across the newest matches
+	counts := map[string]*commitAuthor{}
+	authors := []*commitAuthor{}
+	scrolled := 0
+	err := h.store.ScrollCommits(ctx, p.Source.(*Repository).FullName, graphQLSearch(p), func(c *IndexCommit) error {
+		if scrolled == maxAuthorCommits {
+			return errStopScroll
+		}
+		scrolled++
+		key := c.AuthorLogin
+		if key == "" {
+			key = c.Author
+		}
+		a, ok := counts[key]
+		if !ok {
+			a = &commitAuthor{Name: c.Author, Login: c.AuthorLogin}
+			counts[key] = a
+			authors = append(authors, a)
+		}
+		a.Commits++
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScroll) {
+		return nil, err
+	}
+	sort.SliceStable(authors, func(i, j int) bool {
+		return authors[i].Commits > authors[j].Commits
+	})
+	if len(authors) > first {
+		authors = authors[:first]
+	}
+	return authors, nil
+}
+
+func (h *Handler) resolveSearch(p graphql.ResolveParams) (interface{}, error) {
+	ctx := p.Context
+	first, offset, err := page(p)
+	if err != nil {
+		return nil, err
+	}
+	fullName := p.Args["repository"].(string)
+	if err := h.authorize(ctx, graphQLToken(p), fullName); err != nil {
+		return nil, err
+	}
+	query := graphQLSearch(p)
+	query.Type, _ = p.Args["type"].(string)
+	switch query.Type {
+	case "", DocCommit, DocPullRequest, DocReviewComment:
+	default:
+		return nil, ErrBadRequest
+	}
+
+	// Commits come first, then pull requests and review comments. Only
+	// the page asked for is read, from the counts of both.
+	var commits, pulls int
+	if query.Wants(DocCommit) {
+		if commits, err = h.store.CountCommits(ctx, fullName, query); err != nil {
+			return nil, err
+		}
+	}
+	if query.Type != DocCommit {
+		if pulls, err = h.store.CountPullRequests(ctx, fullName, query); err != nil {
+			return nil, err
+		}
+	}
+	end := min(offset+first, commits+pulls)
+	nodes := []interface{}{}
+	if offset < commits {
+		q := *query
+		q.From, q.Size = offset, min(end, commits)-offset
+		page, err := h.store.GetCommits(ctx, fullName, &q)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page {
+			nodes = append(nodes, c)
+		}
+	}
+	if end > max(offset, commits) {
+		q := *query
+		q.From = max(offset-commits, 0)
+		q.Size = end - commits - q.From
+		page, err := h.store.GetPullRequests(ctx, fullName, &q)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range page {
+			nodes = append(nodes, pr)
+		}
+	}
+	conn := pageOf(nodes, 0, first).shift(offset)
+	conn.PageInfo.HasNextPage = end < commits+pulls
+	return conn, nil
+}
+
+// resolveAuthor builds the author of a commit or commit detail
+func resolveAuthor(p graphql.ResolveParams) (interface{}, error) {
+	switch c := p.Source.(type) {
+	case *IndexCommit:
+		return &commitAuthor{Name: c.Author, Login: c.AuthorLogin}, nil
+	case *CommitDetail:
+		return &commitAuthor{Name: c.Author, Login: c.AuthorLogin}, nil
+	}
+	return nil, nil
+}
+
+// graphQLToken returns the Github token of the user running a query
+func graphQLToken(p graphql.ResolveParams) string {
+	token, _ := p.Context.Value(tokenKey{}).(string)
+	return token
+}
+
+// graphQLSearch reads the search arguments of a field
+func graphQLSearch(p graphql.ResolveParams) *SearchQuery {
+	q := &SearchQuery{}
+	q.Term, _ = p.Args["query"].(string)
+	q.Branch, _ = p.Args["branch"].(string)
+	q.Tag, _ = p.Args["tag"].(string)
+	return q
+}
+
+// page reads the first and after arguments of a connection
+func page(p graphql.ResolveParams) (first, offset int, err error) {
+	first, _ = p.Args["first"].(int)
+	if first <= 0 || first > maxPageSize {
+		return 0, 0, ErrBadRequest
+	}
+	if after, ok := p.Args["after"].(string); ok && after != "" {
+		if offset, err = decodeCursor(after); err != nil {
+			return 0, 0, err
+		}
+	}
+	return first, offset, nil
+}
+
+// pageOf returns the page of nodes starting at offset
+func pageOf(nodes []interface{}, offset, first int) *connection {
+	if offset > len(nodes) {
+		offset = len(nodes)
+	}
+	end := offset + first
+	if end > len(nodes) {
+		end = len(nodes)
+	}
+	conn := &connection{
+		Edges:    []*edge{},
+		PageInfo: &pageInfo{HasNextPage: end < len(nodes)},
+	}
+	for i := offset; i < end; i++ {
+		conn.Edges = append(conn.Edges, &edge{Cursor: encodeCursor(i + 1), Node: nodes[i]})
+	}
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.EndCursor = conn.Edges[len(conn.Edges)-1].Cursor
+	}
+	return conn
+}
+
+// shift moves the cursors of a page that was read starting at offset
+func (c *connection) shift(offset int) *connection {
+	for i, e := range c.Edges {
+		e.Cursor = encodeCursor(offset + i + 1)
+	}
+	if len(c.Edges) > 0 {
+		c.PageInfo.EndCursor = c.Edges[len(c.Edges)-1].Cursor
+	}
+	return c
+}
+
+// encodeCursor encodes the number of nodes up to and including an edge
+func encodeCursor(offset int) string {
+	return base64.StdEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(b), cursorPrefix) {
+		return 0, ErrBadRequest
+	}
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(b), cursorPrefix))
+	if err != nil || offset < 0 {
+		return 0, ErrBadRequest
+	}
+	return offset, nil
+}
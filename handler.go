@@ -1,36 +1,187 @@
 package search
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"net/mail"
+	"net/netip"
 	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	// ErrNoSession is returned when a request carries no login cookie
+	ErrNoSession = errors.New("unauthorized user")
+
+	// ErrBadRequest is returned when a request cannot be parsed
+	ErrBadRequest = errors.New("malformed request")
+
+	// ErrForbidden is returned when a user is not a member of a workspace
+	ErrForbidden = errors.New("not a member of this workspace")
+
+	// ErrNotOwner is returned when a member who does not own a workspace
+	// invites others to it
+	ErrNotOwner = errors.New("not the owner of this workspace")
+)
+
+// DefaultScopes are the OAuth scopes requested when none are configured
+var DefaultScopes = []string{"public_repo"}
+
+// Config holds the settings of a Handler
+type Config struct {
+	// Scopes are the OAuth scopes requested at login
+	Scopes []string
+
+	// SMTP is the mail server alerts of saved searches are sent through
+	SMTP SMTPConfig
+
+	// Workers is the number of background jobs run at once
+	Workers int
+
+	// Logger receives the logs of the handler, its Github client and its
+	// jobs, slog.Default() when nil
+	Logger *slog.Logger
+
+	// MetricsToken is the bearer token /metrics requires. Metrics are not
+	// served without one.
+	MetricsToken string
+
+	// HTTPClient sends the requests to Github, a client timing out after
+	// DefaultHTTPTimeout when nil
+	HTTPClient *http.Client
+
+	// GithubAPI and GithubURL locate the Github API and the site serving
+	// OAuth logins, DefaultGithubAPI and DefaultGithubURL when nil. Point
+	// them at Github Enterprise or at a githubtest server.
+	GithubAPI *url.URL
+	GithubURL *url.URL
+
+	// Secrets holds the clientID, clientSecret and githubState of the
+	// OAuth app, read from secrets() when nil
+	Secrets map[string]string
+
+	// StaticDir holds the page templates and static files, "static" when
+	// empty
+	StaticDir string
+
+	// Admins are the Github logins allowed into the admin console, which
+	// is closed when empty
+	Admins []string
+
+	// PublicURL is where users reach the app, DefaultPublicURL when nil.
+	// OAuth redirects and links point at it, and the session cookie is
+	// only sent over TLS when it is https.
+	PublicURL *url.URL
+}
+
+// DefaultPublicURL is where the app is reached when no PublicURL is
+// configured
+const DefaultPublicURL = "http://localhost:9000"
+
+// DefaultHTTPTimeout bounds requests to Github when no HTTPClient is
+// configured
+const DefaultHTTPTimeout = 30 * time.Second
+
+// DefaultWorkers is the number of job workers when none are configured
+const DefaultWorkers = 2
+
 // Handler serves as a global context
 type Handler struct {
 	client    *Client
-	store     *Store
+	store     Storage
 	templates *template.Template
+	static    string
 	secrets   map[string]string
 	domain    string
+	secure    bool
+	scopes    []string
+	admins    []string
+	notifier  *Notifier
+	jobs      *JobQueue
+	schema    graphql.Schema
+	log       *slog.Logger
+
+	registry     *prometheus.Registry
+	metricsToken string
 }
 
-// NewHandler creates a new handler
-func NewHandler() *Handler {
+// NewHandler creates a new handler backed by store
+func NewHandler(store Storage, config Config) *Handler {
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	workers := config.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultHTTPTimeout}
+	}
+	apiURL := config.GithubAPI
+	if apiURL == nil {
+		apiURL, _ = url.Parse(DefaultGithubAPI)
+	}
+	webURL := config.GithubURL
+	if webURL == nil {
+		webURL, _ = url.Parse(DefaultGithubURL)
+	}
+	appSecrets := config.Secrets
+	if appSecrets == nil {
+		appSecrets = secrets()
+	}
+	static := config.StaticDir
+	if static == "" {
+		static = "static"
+	}
+	publicURL := config.PublicURL
+	if publicURL == nil {
+		publicURL, _ = url.Parse(DefaultPublicURL)
+	}
+	jobs := NewJobQueue(workers, logger)
 	return &Handler{
-		client:    NewClient(secrets()),
-		store:     NewStore(),
-		templates: templates(),
-		secrets:   secrets(),
-		domain:    "http://localhost:9000",
+		client:       NewClient(appSecrets, apiURL, webURL, httpClient, logger),
+		store:        store,
+		templates:    templates(static),
+		static:       static,
+		secrets:      appSecrets,
+		domain:       strings.TrimSuffix(publicURL.String(), "/"),
+		secure:       publicURL.Scheme == "https",
+		scopes:       scopes,
+		admins:       config.Admins,
+		notifier:     NewNotifier(config.SMTP),
+		jobs:         jobs,
+		log:          logger,
+		registry:     newRegistry(store, jobs, logger),
+		metricsToken: config.MetricsToken,
 	}
 }
 
+// Shutdown stops accepting background jobs and waits for queued and running
+// ones, such as repository ingestion, to finish or for ctx to be done
+func (h *Handler) Shutdown(ctx context.Context) error {
+	return h.jobs.Close(ctx)
+}
+
 // NewRouter creates a new router
 func (h *Handler) NewRouter() http.Handler {
 	r := mux.NewRouter()
@@ -38,26 +189,64 @@ func (h *Handler) NewRouter() http.Handler {
 		Methods("GET")
 	r.HandleFunc("/dashboard", h.getDashboardHandler).
 		Methods("GET")
-	r.HandleFunc("/dashboard/{repository}", h.getRepositoryHandler).
+	r.HandleFunc("/dashboard/{owner}/{repository}", h.getRepositoryHandler).
+		Methods("GET")
+	r.HandleFunc("/dashboard/{owner}/{repository}/commits", h.getRepositoryCommitsHandler).
+		Methods("GET")
+	r.HandleFunc("/dashboard/{owner}/{repository}/commits/{sha}", h.getCommitHandler).
 		Methods("GET")
-	r.HandleFunc("/dashboard/{repository}/commits", h.getRepositoryCommitsHandler).
+	r.HandleFunc("/dashboard/{owner}/{repository}/search", h.getRepositorySearchHandler).
 		Methods("GET")
+	r.HandleFunc("/dashboard/{owner}/{repository}/sync", h.postRepositorySyncHandler).
+		Methods("POST")
+	r.HandleFunc("/dashboard/{owner}/{repository}/branches", h.getRepositoryBranchesHandler).
+		Methods("GET")
+	r.HandleFunc("/dashboard/{owner}/{repository}/branches", h.postRepositoryBranchesHandler).
+		Methods("POST")
 	r.HandleFunc("/repositories", h.getRepositoriesHandler).
 		Methods("GET")
 	r.HandleFunc("/repositories/active", h.getActiveRepositoriesHandler).
 		Methods("GET")
 	r.HandleFunc("/repositories/activate", h.postActivateRepositoriesHandler).
 		Methods("POST")
+	r.HandleFunc("/repositories/deactivate", h.postDeactivateRepositoriesHandler).
+		Methods("POST")
 	r.HandleFunc("/refresh/repositories", h.getRefreshRepositoryHandler).
 		Methods("GET")
+	r.HandleFunc("/searches", h.getSearchesHandler).
+		Methods("GET")
+	r.HandleFunc("/searches", h.postSearchesHandler).
+		Methods("POST")
+	r.HandleFunc("/searches/{id}", h.deleteSearchHandler).
+		Methods("DELETE")
+	r.HandleFunc("/workspaces", h.getWorkspacesHandler).
+		Methods("GET")
+	r.HandleFunc("/workspaces", h.postWorkspacesHandler).
+		Methods("POST")
+	r.HandleFunc("/workspaces/{id}/members", h.postWorkspaceMembersHandler).
+		Methods("POST")
+	r.HandleFunc("/workspaces/{id}/repositories", h.postWorkspaceRepositoriesHandler).
+		Methods("POST")
 	r.HandleFunc("/login", h.getLoginHandler).
 		Methods("GET")
+	r.HandleFunc("/login/upgrade", h.getLoginUpgradeHandler).
+		Methods("GET")
 	r.HandleFunc("/logout", h.deleteLogoutHandler).
 		Methods("DELETE")
 	r.HandleFunc("/login/callback", h.getLoginCallbackHandler).
 		Methods("GET")
-	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("static/"))))
-	return handlers.HTTPMethodOverrideHandler(r)
+	r.HandleFunc("/metrics", h.getMetricsHandler).
+		Methods("GET")
+	r.HandleFunc("/healthz", h.getHealthzHandler).
+		Methods("GET")
+	r.HandleFunc("/readyz", h.getReadyzHandler).
+		Methods("GET")
+	h.registerAPI(r)
+	h.registerGraphQL(r)
+	h.registerAdmin(r)
+	r.Use(measureRequests, h.auditRequests)
+	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(h.static))))
+	return handlers.HTTPMethodOverrideHandler(h.traceRequests(r))
 }
 
 func (h *Handler) getRootHandler(w http.ResponseWriter, r *http.Request) {
@@ -85,23 +274,24 @@ func (h *Handler) getRepositoryHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) getRefreshRepositoryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	token := currentUser(r)
 	if token == "" {
-		http.Error(w, "unauthorized user", http.StatusForbidden)
+		writeError(w, r, ErrNoSession)
 		return
 	}
 
 	// Retrieve repositories from Github
-	repos, err := h.client.getRepositories(token)
+	repos, err := h.client.getRepositories(ctx, token)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	// Place respositories in elastic search
 	for i := 0; i < len(repos); i++ {
-		if err := h.store.CreateRepositoryList(token, repos[i]); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := h.store.CreateRepositoryList(ctx, token, repos[i]); err != nil {
+			writeError(w, r, err)
 			return
 		}
 	}
@@ -109,162 +299,1034 @@ func (h *Handler) getRefreshRepositoryHandler(w http.ResponseWriter, r *http.Req
 }
 
 func (h *Handler) postActivateRepositoriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	token := currentUser(r)
 	if token == "" {
-		http.Error(w, "unauthorized user", http.StatusForbidden)
+		writeError(w, r, ErrNoSession)
 		return
 	}
 
 	// Parse request
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "unauthorized user", http.StatusForbidden)
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	fullName := r.FormValue("full_name")
+	if event := auditEvent(ctx); event != nil {
+		event.Target = fullName
+	}
+	owner, name, ok := splitFullName(fullName)
+	if !ok {
+		writeError(w, r, ErrBadRequest)
 		return
 	}
-	name := r.FormValue("name")
 
-	// Check if a repository already exists
-	if !h.store.RepoExists(token, name) {
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-		// Create and populate the repository with commits
-		un, err := h.client.getUsername(token)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		} else if commits, err := h.client.getCommits(token, name, un); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		} else if err = h.store.CreateRepository(name, un, token, commits); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// Index the repository unless another user already has
+	if err := h.indexRepository(ctx, token, owner, name); err != nil {
+		writeError(w, r, err)
+		return
 	}
 
 	// Update repositorylist with active status
-	if err := h.store.ActivateRepository(token, name); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.store.ActivateRepository(ctx, token, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+}
+
+// postDeactivateRepositoriesHandler removes a repository from the user's
+// active repositories. Its commits stay indexed, for other users and for
+// activating it again.
+func (h *Handler) postDeactivateRepositoriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse request
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	fullName := r.FormValue("full_name")
+	if event := auditEvent(ctx); event != nil {
+		event.Target = fullName
+	}
+	if _, _, ok := splitFullName(fullName); !ok {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+
+	// Update repositorylist with inactive status
+	if err := h.store.DeactivateRepository(ctx, token, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) getWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Retrieve the user's workspaces
+	workspaces, err := h.workspaces(ctx, token)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Send a successful response
+	if workspaces == nil {
+		workspaces = []*Workspace{}
+	}
+	if err := json.NewEncoder(w).Encode(workspaces); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) postWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse request
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+
+	// Create a workspace owned by the user
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id, err := newID()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ws := &Workspace{
+		ID:           id,
+		Name:         name,
+		Owner:        login,
+		Members:      []string{login},
+		Repositories: []string{},
+	}
+	if err := h.store.SaveWorkspace(ctx, ws); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Send a successful response
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(ws); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) postWorkspaceMembersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse request
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	member := r.FormValue("login")
+	if member == "" {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+
+	// Only the owner may invite others
+	ws, err := h.memberWorkspace(ctx, token, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	} else if login != ws.Owner {
+		writeError(w, r, ErrNotOwner)
+		return
+	}
+
+	// Add the member
+	if err := h.store.AddWorkspaceMember(ctx, ws.ID, member); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) postWorkspaceRepositoriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse request
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	fullName := r.FormValue("full_name")
+	owner, name, ok := splitFullName(fullName)
+	if !ok {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+
+	// Only members with access on Github may share a repository
+	ws, err := h.memberWorkspace(ctx, token, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, err := h.client.getRepository(ctx, token, owner, name); errors.Is(err, ErrNotFound) {
+		writeError(w, r, ErrRepoNotFound)
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Index the repository and add it to the workspace
+	if err := h.indexRepository(ctx, token, owner, name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := h.store.AddWorkspaceRepository(ctx, ws.ID, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) getSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Retrieve the user's saved searches
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	searches, err := h.store.GetSearches(ctx, login)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
+	// Send a successful response
+	if searches == nil {
+		searches = []*SavedSearch{}
+	}
+	if err := json.NewEncoder(w).Encode(searches); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) postSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse request
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	ss := &SavedSearch{
+		Name:       r.FormValue("name"),
+		Repository: r.FormValue("full_name"),
+		Term:       r.FormValue("term"),
+		Branch:     r.FormValue("branch"),
+		Tag:        r.FormValue("tag"),
+		Webhook:    r.FormValue("webhook"),
+		Email:      r.FormValue("email"),
+	}
+	if err := h.saveSearch(ctx, token, ss); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Send a successful response
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(ss); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) deleteSearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	if err := h.deleteSearch(ctx, token, mux.Vars(r)["id"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// saveSearch validates a search and saves it for the user
+func (h *Handler) saveSearch(ctx context.Context, token string, ss *SavedSearch) error {
+	if err := validateSearch(ss); err != nil {
+		return err
+	}
+
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, ss.Repository); err != nil {
+		return err
+	}
+
+	// Save the search for the user
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return err
+	}
+	if ss.ID, err = newID(); err != nil {
+		return err
+	}
+	ss.Owner, ss.token = login, token
+	return h.store.SaveSearch(ctx, ss)
+}
+
+// deleteSearch deletes a saved search. Only its owner may delete it.
+func (h *Handler) deleteSearch(ctx context.Context, token, id string) error {
+	ss, err := h.store.GetSearch(ctx, id)
+	if err != nil {
+		return err
+	}
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return err
+	} else if ss.Owner != login {
+		return ErrSearchNotFound
+	}
+	return h.store.DeleteSearch(ctx, ss.ID)
+}
+
+// validateSearch checks a saved search has a name, a repository and at
+// least one valid destination for its alerts
+func validateSearch(ss *SavedSearch) error {
+	if _, _, ok := splitFullName(ss.Repository); !ok {
+		return ErrBadRequest
+	}
+	if ss.Name == "" || strings.ContainsAny(ss.Name, "\r\n") {
+		return ErrBadRequest
+	}
+	if ss.Webhook == "" && ss.Email == "" {
+		return ErrBadRequest
+	}
+	if ss.Webhook != "" {
+		u, err := url.Parse(ss.Webhook)
+		if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			return ErrBadRequest
+		}
+		// Names are checked as webhooks are posted, once resolved
+		if addr, err := netip.ParseAddr(u.Hostname()); (err == nil && !isPublicAddr(addr)) || strings.EqualFold(u.Hostname(), "localhost") {
+			return ErrWebhookAddress
+		}
+	}
+	if ss.Email != "" {
+		addr, err := mail.ParseAddress(ss.Email)
+		if err != nil {
+			return ErrBadRequest
+		}
+		ss.Email = addr.Address
+	}
+	return nil
+}
+
+// memberWorkspace retrieves a workspace the user is a member of
+func (h *Handler) memberWorkspace(ctx context.Context, token, id string) (*Workspace, error) {
+	ws, err := h.store.GetWorkspace(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return nil, err
+	} else if !ws.HasMember(login) {
+		return nil, ErrForbidden
+	}
+	return ws, nil
 }
 
 func (h *Handler) getActiveRepositoriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	token := currentUser(r)
 	if token == "" {
-		http.Error(w, "unauthorized user", http.StatusForbidden)
+		writeError(w, r, ErrNoSession)
 		return
 	}
 
 	// Retrieve active repositories from elasticsearch
-	repos, err := h.store.GetActiveRepositories(token)
-	if err != nil {
-		http.Error(w, "unauthorized user", http.StatusForbidden)
+	repos, err := h.store.GetActiveRepositories(ctx, token)
+	if err != nil && !errors.Is(err, ErrUserNotFound) && !errors.Is(err, ErrRepoTypeMissing) {
+		writeError(w, r, err)
 		return
 	}
 
-	// Package and send as an array of repository names
-	var repoNames []string
+	// Package and send as an array of repository full names, leaving out
+	// private repositories the user can no longer read
+	repoNames := make([]string, 0, len(repos))
 	for _, repo := range repos {
-		repoNames = append(repoNames, repo.Name)
+		if err := h.checkAccess(ctx, token, repo); errors.Is(err, ErrRepoNotFound) {
+			continue
+		} else if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		repoNames = append(repoNames, repo.FullName)
+	}
+
+	// Add the repositories of the user's workspaces
+	workspaces, err := h.workspaces(ctx, token)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for _, ws := range workspaces {
+		for _, fullName := range ws.Repositories {
+			if !contains(repoNames, fullName) {
+				repoNames = append(repoNames, fullName)
+			}
+		}
 	}
 	if err = json.NewEncoder(w).Encode(&repoNames); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 }
 
 func (h *Handler) getRepositoriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	token := currentUser(r)
 	if token == "" {
-		http.Error(w, "unauthorized user", http.StatusForbidden)
+		writeError(w, r, ErrNoSession)
 		return
 	}
 
 	// Retrieve repositores from elastic search
 	search := r.URL.Query().Get("term")
-	repos, err := h.store.GetRepositories(token, search)
-	if err != nil && (err.Error() == "no repository type exists for this token" || err.Error() == "no user exists for this token") {
+	repos, err := h.store.GetRepositories(ctx, token, search)
+	if errors.Is(err, ErrRepoTypeMissing) || errors.Is(err, ErrUserNotFound) {
 
 		// Create a user if no user exists
-		if err.Error() == "no user exists for this token" {
-			if err := h.store.CreateUserIndex(token); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, ErrUserNotFound) {
+			if err := h.store.CreateUserIndex(ctx, token); err != nil {
+				writeError(w, r, err)
 				return
 			}
 		}
 
 		// Retrieve repositories from Github
-		repos, err = h.client.getRepositories(token)
+		repos, err = h.client.getRepositories(ctx, token)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 
 		// Place respositories in elastic search
 		for i := 0; i < len(repos); i++ {
-			if err := h.store.CreateRepositoryList(token, repos[i]); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if err := h.store.CreateRepositoryList(ctx, token, repos[i]); err != nil {
+				writeError(w, r, err)
 				return
 			}
 		}
 	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// Format data for autocomplete
-	var results []string
-	for _, r := range repos {
-		results = append(results, r.Name)
+	// Send repositories for autocomplete
+	if repos == nil {
+		repos = []*Repository{}
 	}
-
-	// Send successful response
-	if err := json.NewEncoder(w).Encode(results); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(repos); err != nil {
+		writeError(w, r, err)
 		return
 	}
 }
 
 func (h *Handler) getRepositoryCommitsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	token := currentUser(r)
 	if token == "" {
-		http.Error(w, "unauthorized user", http.StatusForbidden)
+		writeError(w, r, ErrNoSession)
 		return
 	}
 
 	// Parse URL params
 	args := mux.Vars(r)
-	repoName := args["repository"]
-	search := r.URL.Query().Get("term")
+	fullName := args["owner"] + "/" + args["repository"]
+	params := r.URL.Query()
+	query := &SearchQuery{
+		Term:   params.Get("term"),
+		Branch: params.Get("branch"),
+		Tag:    params.Get("tag"),
+	}
+
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Stream every matching commit when an export format is asked for
+	if format := params.Get("format"); format != "" && format != "json" {
+		ew := &exportWriter{ResponseWriter: w}
+		err := h.exportCommits(ctx, ew, r, fullName, query, format)
+		if err != nil && !ew.started {
+			w.Header().Del("Content-Disposition")
+			writeError(w, r, err)
+		} else if err != nil {
+			// Part of the export was sent with a successful status, abort
+			// the response so the client sees it was cut short
+			requestLogger(ctx).Error("export failed", "repository", fullName, "format", format, "error", redactURL(err))
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
 
 	// Get commits from elasticsearch
-	commits, err := h.store.GetCommits(token, repoName, search)
+	commits, err := h.store.GetCommits(ctx, fullName, query)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	// Send a successful response
 	if err := json.NewEncoder(w).Encode(&commits); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+}
+
+// shaPattern matches full and abbreviated commit shas
+var shaPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+// getCommitHandler serves the page of a commit, or its details as JSON when
+// the request accepts JSON
+func (h *Handler) getCommitHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if !acceptsJSON(r) {
+		if token == "" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		h.templates.ExecuteTemplate(w, "commit.html", nil)
+		return
+	}
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse URL params
+	args := mux.Vars(r)
+	owner, name, sha := args["owner"], args["repository"], args["sha"]
+	if !shaPattern.MatchString(sha) {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, owner+"/"+name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	detail, err := h.commitDetail(ctx, token, owner, name, sha)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Send a successful response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(detail); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// commitDetail reads the details of a commit from storage, fetching and
+// storing them the first time the commit is viewed
+func (h *Handler) commitDetail(ctx context.Context, token, owner, name, sha string) (*CommitDetail, error) {
+	fullName := owner + "/" + name
+	detail, err := h.store.GetCommitDetail(ctx, fullName, sha)
+	if err == nil || !errors.Is(err, ErrCommitNotFound) {
+		return detail, err
+	}
+
+	commit, err := h.client.getCommit(ctx, token, owner, name, sha)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrCommitNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	detail = newCommitDetail(fullName, commit)
+	if err := h.store.SaveCommitDetail(ctx, detail); err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// searchResponse holds the commits and pull requests matching a search
+type searchResponse struct {
+	Commits      []*IndexCommit      `json:"commits"`
+	PullRequests []*IndexPullRequest `json:"pull_requests"`
+}
+
+// getRepositorySearchHandler searches commits, pull requests and review
+// comments together. The type parameter narrows the search to one kind.
+func (h *Handler) getRepositorySearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse URL params
+	args := mux.Vars(r)
+	fullName := args["owner"] + "/" + args["repository"]
+	params := r.URL.Query()
+	query := &SearchQuery{
+		Term:   params.Get("term"),
+		Branch: params.Get("branch"),
+		Tag:    params.Get("tag"),
+		Type:   params.Get("type"),
+	}
+
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	resp, err := h.search(ctx, fullName, query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Send a successful response
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// search searches each kind of document asked for in a repository
+func (h *Handler) search(ctx context.Context, fullName string, query *SearchQuery) (*searchResponse, error) {
+	switch query.Type {
+	case "", DocCommit, DocPullRequest, DocReviewComment:
+	default:
+		return nil, ErrBadRequest
+	}
+
+	resp := &searchResponse{
+		Commits:      []*IndexCommit{},
+		PullRequests: []*IndexPullRequest{},
+	}
+	if query.Wants(DocCommit) {
+		commits, err := h.store.GetCommits(ctx, fullName, query)
+		if err != nil {
+			return nil, err
+		}
+		resp.Commits = append(resp.Commits, commits...)
+	}
+	if query.Type != DocCommit {
+		pulls, err := h.store.GetPullRequests(ctx, fullName, query)
+		if err != nil {
+			return nil, err
+		}
+		resp.PullRequests = append(resp.PullRequests, pulls...)
+	}
+	return resp, nil
+}
+
+// postRepositorySyncHandler fetches the commits and pull requests of a
+// repository again
+func (h *Handler) postRepositorySyncHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse URL params
+	args := mux.Vars(r)
+	owner, name := args["owner"], args["repository"]
+
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, owner+"/"+name); err != nil {
+		writeError(w, r, err)
 		return
 	}
+
+	// Fetch the repository again in the background
+	job, err := h.enqueue(ctx, token, JobSync, owner+"/"+name, func(ctx context.Context) error {
+		return h.syncRepository(ctx, token, owner, name)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// branchesResponse lists the branches and tags of a repository, and the
+// branches chosen for indexing
+type branchesResponse struct {
+	DefaultBranch string   `json:"default_branch"`
+	Branches      []string `json:"branches"`
+	Tags          []string `json:"tags"`
+	Indexed       []string `json:"indexed"`
+}
+
+func (h *Handler) getRepositoryBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse URL params
+	args := mux.Vars(r)
+	owner, name := args["owner"], args["repository"]
+	fullName := owner + "/" + name
+
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Retrieve branches and tags from Github
+	repo, err := h.client.getRepository(ctx, token, owner, name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	branches, err := h.client.getBranches(ctx, token, owner, name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	tags, err := h.client.getTags(ctx, token, owner, name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Retrieve the branches chosen for indexing
+	indexed, err := h.store.GetBranches(ctx, fullName)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	} else if len(indexed) == 0 {
+		indexed = []string{repo.DefaultBranch}
+	}
+
+	// Send a successful response
+	resp := &branchesResponse{
+		DefaultBranch: repo.DefaultBranch,
+		Branches:      refNames(branches),
+		Tags:          refNames(tags),
+		Indexed:       indexed,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) postRepositoryBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := currentUser(r)
+	if token == "" {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+
+	// Parse request
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+	args := mux.Vars(r)
+	owner, name := args["owner"], args["repository"]
+	fullName := owner + "/" + name
+	chosen := r.Form["branch"]
+	if len(chosen) == 0 {
+		writeError(w, r, ErrBadRequest)
+		return
+	}
+
+	// Confirm the user can read the repository
+	if err := h.authorize(ctx, token, fullName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Every chosen branch must exist on Github
+	branches, err := h.client.getBranches(ctx, token, owner, name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	names := refNames(branches)
+	for _, branch := range chosen {
+		if !contains(names, branch) {
+			writeError(w, r, ErrBadRequest)
+			return
+		}
+	}
+
+	// Store the choice and index the repository again in the background
+	if err := h.store.SetBranches(ctx, fullName, chosen); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	job, err := h.enqueue(ctx, token, JobSync, fullName, func(ctx context.Context) error {
+		return h.syncRepository(ctx, token, owner, name)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
 }
 
 func (h *Handler) getLoginHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, h.authorizeURL(h.scopes), http.StatusFound)
+}
+
+// getLoginUpgradeHandler sends the user back through OAuth asking for the
+// repo scope, which grants access to private repositories
+func (h *Handler) getLoginUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	scopes := []string{"repo"}
+	for _, scope := range h.scopes {
+		if scope != "repo" && scope != "public_repo" {
+			scopes = append(scopes, scope)
+		}
+	}
+	http.Redirect(w, r, h.authorizeURL(scopes), http.StatusFound)
+}
+
+func (h *Handler) authorizeURL(scopes []string) string {
 	// Create url
-	u := new(url.URL)
-	u.Scheme = "https"
-	u.Host = "github.com"
-	u.Path = "/login/oauth/authorize"
-	params := u.Query()
+	params := url.Values{}
 	params.Add("client_id", h.secrets["clientID"])
 	params.Add("redirect_uri", h.domain+"/login/callback")
-	params.Add("scope", "public_repo")
+	params.Add("scope", strings.Join(scopes, " "))
 	params.Add("state", h.secrets["githubState"])
-	u.RawQuery = params.Encode()
+	return h.client.oauthURL("/login/oauth/authorize", params)
+}
 
-	// Send a successful response
-	http.Redirect(w, r, u.String(), http.StatusFound)
+// checkAccess confirms the user can still read a repository from their
+// repository list. Private repositories are checked on every request, so
+// revoked access hides them straight away.
+func (h *Handler) checkAccess(ctx context.Context, token string, repo *Repository) error {
+	if !repo.Private {
+		return nil
+	}
+	return h.authorize(ctx, token, repo.FullName)
+}
+
+// authorize confirms the user can read the commits of a repository, either
+// as a member of a workspace holding it or through their access on Github.
+// Repeated Github checks are conditional requests and do not count against
+// the rate limit.
+func (h *Handler) authorize(ctx context.Context, token, fullName string) error {
+	// Members of a workspace holding the repository may read it
+	workspaces, err := h.workspaces(ctx, token)
+	if err != nil {
+		return err
+	}
+	for _, ws := range workspaces {
+		if ws.HasRepository(fullName) {
+			return nil
+		}
+	}
+
+	// Otherwise the user needs access on Github
+	owner, name, ok := splitFullName(fullName)
+	if !ok {
+		return ErrRepoNotFound
+	}
+	if _, err := h.client.getRepository(ctx, token, owner, name); errors.Is(err, ErrNotFound) {
+		return ErrRepoNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// indexRepository fetches and indexes a repository once, however many users
+// activate it
+func (h *Handler) indexRepository(ctx context.Context, token, owner, name string) error {
+	if h.store.RepoExists(ctx, owner+"/"+name) {
+		return nil
+	}
+	return h.syncRepository(ctx, token, owner, name)
+}
+
+// syncRepository fetches the commits, pull requests and review comments of
+// a repository and replaces those indexed before. Saved searches are run
+// against commits that are new to a repository already indexed.
+func (h *Handler) syncRepository(ctx context.Context, token, owner, name string) error {
+	fullName := owner + "/" + name
+	existed := h.store.RepoExists(ctx, fullName)
+	commits, err := h.fetchCommits(ctx, token, owner, name)
+	if err != nil {
+		return err
+	}
+	added, err := h.store.CreateRepository(ctx, fullName, commits)
+	if err != nil {
+		return err
+	}
+	if existed && len(added) > 0 {
+		h.alert(ctx, fullName, added)
+	}
+
+	pulls, err := h.client.getPullRequests(ctx, token, owner, name)
+	if err != nil {
+		return err
+	}
+	comments, err := h.client.getReviewComments(ctx, token, owner, name)
+	if err != nil {
+		return err
+	}
+	return h.store.CreatePullRequests(ctx, fullName, pulls, comments)
+}
+
+// alert delivers the new commits matched by saved searches. Failed
+// deliveries do not fail the sync.
+func (h *Handler) alert(ctx context.Context, fullName string, commits []*IndexCommit) {
+	alerts, err := h.store.MatchSearches(ctx, fullName, commits)
+	if err != nil {
+		h.log.Error("matching saved searches failed", "repository", fullName, "error", err)
+		return
+	}
+	for _, alert := range alerts {
+		if !h.canAlert(ctx, alert.Search) {
+			continue
+		}
+		if err := h.notifier.Notify(ctx, alert); err != nil {
+			h.log.Error("delivering alert failed", "search", alert.Search.ID, "repository", fullName, "error", redactURL(err))
+			continue
+		}
+		h.log.Info("delivered alert", "search", alert.Search.ID, "repository", fullName, "commits", len(alert.Commits))
+	}
+}
+
+// canAlert checks the owner of a saved search can still read its
+// repository, the way searches are checked. Searches whose owner lost
+// access or revoked their token are deleted, other failures only skip
+// this alert.
+func (h *Handler) canAlert(ctx context.Context, ss *SavedSearch) bool {
+	if ss.token == "" {
+		h.log.Warn("saved search has no owner token, skipping alert until it is saved again", "search", ss.ID, "repository", ss.Repository)
+		return false
+	}
+	err := h.authorize(ctx, ss.token, ss.Repository)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrRepoNotFound) || errors.Is(err, ErrUnauthorized):
+		h.log.Info("owner lost access, deleting saved search", "search", ss.ID, "repository", ss.Repository, "owner", ss.Owner)
+		if err := h.store.DeleteSearch(ctx, ss.ID); err != nil && !errors.Is(err, ErrSearchNotFound) {
+			h.log.Error("deleting saved search failed", "search", ss.ID, "error", err)
+		}
+	default:
+		h.log.Error("checking access of saved search failed", "search", ss.ID, "repository", ss.Repository, "error", redactURL(err))
+	}
+	return false
+}
+
+// fetchCommits retrieves the commits of the branches chosen for a
+// repository from Github
+func (h *Handler) fetchCommits(ctx context.Context, token, owner, name string) ([]*GitCommit, error) {
+	branches, err := h.store.GetBranches(ctx, owner+"/"+name)
+	if err != nil {
+		return nil, err
+	}
+	return h.client.getBranchCommits(ctx, token, owner, name, branches)
+}
+
+// refNames lists the names of branches or tags
+func refNames(refs []*Ref) []string {
+	names := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+// workspaces retrieves the workspaces the user is a member of
+func (h *Handler) workspaces(ctx context.Context, token string) ([]*Workspace, error) {
+	login, err := h.client.getUsername(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return h.store.GetWorkspaces(ctx, login)
 }
 
 func (h *Handler) deleteLogoutHandler(w http.ResponseWriter, r *http.Request) {
@@ -276,6 +1338,7 @@ func (h *Handler) deleteLogoutHandler(w http.ResponseWriter, r *http.Request) {
 			Path:     "/",
 			Expires:  time.Now(),
 			HttpOnly: true,
+			Secure:   h.secure,
 			MaxAge:   -1,
 		}
 		http.SetCookie(w, &cookie)
@@ -286,16 +1349,30 @@ func (h *Handler) deleteLogoutHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) getLoginCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	// Parse parameters
 	code := r.URL.Query().Get("code")
 
 	// Request token from github
-	resp, err := h.client.postAccessToken(code)
+	resp, err := h.client.postAccessToken(ctx, code, h.domain+"/login/callback")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
+	// Record the login for the admin console, signing in does not depend
+	// on it
+	if login, err := h.client.getLogin(ctx, resp.AccessToken); err != nil {
+		requestLogger(ctx).Warn("looking up login failed", "error", redactURL(err))
+	} else {
+		if event := auditEvent(ctx); event != nil {
+			event.Login, event.UserKey = login, userKey(resp.AccessToken)
+		}
+		if err := h.store.SaveLogin(ctx, resp.AccessToken, login); err != nil {
+			requestLogger(ctx).Warn("recording login failed", "login", login, "error", err)
+		}
+	}
+
 	// Create domain wide cookie
 	expire := time.Now().Add(time.Hour * 24 * 7)
 	cookie := http.Cookie{
@@ -304,31 +1381,138 @@ func (h *Handler) getLoginCallbackHandler(w http.ResponseWriter, r *http.Request
 		Path:     "/",
 		Expires:  expire,
 		HttpOnly: true,
+		Secure:   h.secure,
 		MaxAge:   int(expire.Sub(time.Now()).Seconds()),
 	}
 	http.SetCookie(w, &cookie)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+// errorResponse is the JSON body sent for every failed request
+type errorResponse struct {
+	Error *apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError maps an error onto an HTTP status and a JSON error body.
+// Internal errors are logged and hidden from users behind a generic
+// message.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	message := err.Error()
+	if status >= http.StatusInternalServerError {
+		requestLogger(r.Context()).Error("request failed", "path", r.URL.Path, "error", redactURL(err))
+		message = http.StatusText(status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{
+		Error: &apiError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// statusClientClosedRequest is logged for requests whose client
+// disconnected before they were answered
+const statusClientClosedRequest = 499
+
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNoSession):
+		return http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest, "bad_request"
+	case errors.Is(err, ErrWebhookAddress):
+		return http.StatusBadRequest, "webhook_address"
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound, "user_not_found"
+	case errors.Is(err, ErrRepoNotFound):
+		return http.StatusNotFound, "repository_not_found"
+	case errors.Is(err, ErrRepoTypeMissing):
+		return http.StatusNotFound, "repository_list_missing"
+	case errors.Is(err, ErrCommitNotFound):
+		return http.StatusNotFound, "commit_not_found"
+	case errors.Is(err, ErrSearchNotFound):
+		return http.StatusNotFound, "search_not_found"
+	case errors.Is(err, ErrWorkspaceNotFound):
+		return http.StatusNotFound, "workspace_not_found"
+	case errors.Is(err, ErrJobNotFound):
+		return http.StatusNotFound, "job_not_found"
+	case errors.Is(err, ErrReindexRunning):
+		return http.StatusConflict, "reindex_running"
+	case errors.Is(err, ErrQueueFull), errors.Is(err, ErrQueueClosed):
+		return http.StatusServiceUnavailable, "queue_unavailable"
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, "forbidden"
+	case errors.Is(err, ErrNotOwner):
+		return http.StatusForbidden, "not_owner"
+	case errors.Is(err, ErrNotAdmin):
+		return http.StatusForbidden, "not_admin"
+	case errors.Is(err, ErrMetricsDisabled):
+		return http.StatusNotFound, "metrics_disabled"
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, "github_unauthorized"
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "github_not_found"
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, "github_rate_limited"
+	case errors.Is(err, context.Canceled):
+		// The client went away, nobody reads the response
+		return statusClientClosedRequest, "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout"
+	default:
+		return http.StatusInternalServerError, "internal_error"
+	}
+}
+
+// acceptsJSON reports whether a request asks for JSON rather than a page
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// currentUser returns the Github token of the login cookie, or of a bearer
+// Authorization header sent by API clients
 func currentUser(r *http.Request) string {
 	token, err := r.Cookie("token")
 	if err == http.ErrNoCookie {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		}
 		return ""
 	}
 	return token.Value
 }
 
+// newID returns a random identifier
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func baseURL(r *http.Request) string {
 	return r.URL.Scheme + r.URL.Host
 }
 
-func templates() *template.Template {
+func templates(dir string) *template.Template {
 	return template.Must(template.ParseFiles(
-		"static/index.html",
-		"static/dashboard.html",
-		"static/repository.html",
-		"static/_header.html",
-		"static/_nav.html",
-		"static/_footer.html",
+		filepath.Join(dir, "index.html"),
+		filepath.Join(dir, "dashboard.html"),
+		filepath.Join(dir, "repository.html"),
+		filepath.Join(dir, "commit.html"),
+		filepath.Join(dir, "admin.html"),
+		filepath.Join(dir, "_header.html"),
+		filepath.Join(dir, "_nav.html"),
+		filepath.Join(dir, "_footer.html"),
 	))
 }
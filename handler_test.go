@@ -0,0 +1,165 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/amaxwellblair/git_engine/githubtest"
+)
+
+// newTestServer serves a handler backed by a MemoryStore and a fake
+// Github, reached at its own URL like a deployed server
+func newTestServer(t *testing.T) (*httptest.Server, *githubtest.Server) {
+	t.Helper()
+	gh := githubtest.NewServer(nil)
+	t.Cleanup(gh.Close)
+	srv := httptest.NewServer(nil)
+	t.Cleanup(srv.Close)
+	publicURL, _ := url.Parse(srv.URL)
+	h := NewHandler(NewMemoryStore(testLogger), Config{
+		Logger:     testLogger,
+		HTTPClient: gh.Client(),
+		GithubAPI:  gh.BaseURL(),
+		GithubURL:  gh.BaseURL(),
+		Secrets:    gh.Secrets(),
+		StaticDir:  "mitgine/static",
+		PublicURL:  publicURL,
+	})
+	t.Cleanup(func() { h.Shutdown(context.Background()) })
+	srv.Config.Handler = h.NewRouter()
+	return srv, gh
+}
+
+// signIn goes through the OAuth login as a Github user and returns a
+// client holding their session cookie, or no cookie without a login
+func signIn(t *testing.T, srv *httptest.Server, gh *githubtest.Server, login string) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	if login == "" {
+		return client
+	}
+	gh.SetLogin(login)
+	resp, err := client.Get(srv.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/dashboard" {
+		t.Fatalf("login ended at %s with status %d, want the dashboard", resp.Request.URL.Path, resp.StatusCode)
+	}
+	return client
+}
+
+func TestLoginActivateSearch(t *testing.T) {
+	tests := []struct {
+		name         string
+		login        string
+		repository   string
+		term         string
+		wantActivate int
+		wantSearch   int
+		wantCommits  []string
+	}{
+		{
+			name:         "public repository",
+			login:        "octocat",
+			repository:   "octocat/hello-world",
+			term:         "greeting",
+			wantActivate: http.StatusOK,
+			wantSearch:   http.StatusOK,
+			wantCommits:  []string{"Add README", "Fix typo in greeting (#1)", "Refactor greeting into its own package"},
+		},
+		{
+			name:         "own private repository",
+			login:        "octocat",
+			repository:   "octocat/secret",
+			term:         "launch",
+			wantActivate: http.StatusOK,
+			wantSearch:   http.StatusOK,
+			wantCommits:  []string{"Store the launch codes"},
+		},
+		{
+			name:         "organization repository",
+			login:        "hubot",
+			repository:   "octo-org/tools",
+			term:         "release",
+			wantActivate: http.StatusOK,
+			wantSearch:   http.StatusOK,
+			wantCommits:  []string{"Add release script"},
+		},
+		{
+			name:         "private repository of another user",
+			login:        "hubot",
+			repository:   "octocat/secret",
+			term:         "launch",
+			wantActivate: http.StatusNotFound,
+			wantSearch:   http.StatusNotFound,
+		},
+		{
+			name:         "signed out",
+			repository:   "octocat/hello-world",
+			term:         "greeting",
+			wantActivate: http.StatusUnauthorized,
+			wantSearch:   http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, gh := newTestServer(t)
+			client := signIn(t, srv, gh, tt.login)
+
+			// List the repositories as the dashboard does, then activate
+			// one
+			resp, err := client.Get(srv.URL + "/repositories")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			resp, err = client.PostForm(srv.URL+"/repositories/activate", url.Values{"full_name": {tt.repository}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantActivate {
+				t.Fatalf("activating %s: status %d, want %d", tt.repository, resp.StatusCode, tt.wantActivate)
+			}
+
+			// Search the commits indexed on activation
+			params := url.Values{"term": {tt.term}, "type": {DocCommit}}
+			resp, err = client.Get(srv.URL + "/dashboard/" + tt.repository + "/search?" + params.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantSearch {
+				t.Fatalf("searching %s: status %d, want %d", tt.repository, resp.StatusCode, tt.wantSearch)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var found searchResponse
+			if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+				t.Fatal(err)
+			}
+			var messages []string
+			for _, commit := range found.Commits {
+				messages = append(messages, commit.Message)
+			}
+			sort.Strings(messages)
+			if strings.Join(messages, "\n") != strings.Join(tt.wantCommits, "\n") {
+				t.Errorf("found commits %q, want %q", messages, tt.wantCommits)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds each dependency check of /readyz
+const checkTimeout = 3 * time.Second
+
+// healthResponse is the body of /healthz and /readyz
+type healthResponse struct {
+	Status string                  `json:"status"`
+	Checks map[string]*checkResult `json:"checks,omitempty"`
+}
+
+// checkResult is the outcome of a dependency check
+type checkResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// getHealthzHandler reports the process is alive. It checks nothing else,
+// so a dependency outage does not get the process restarted.
+func (h *Handler) getHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&healthResponse{Status: "ok"})
+}
+
+// getReadyzHandler reports whether the storage and the Github API can
+// serve requests, checking both at once
+func (h *Handler) getReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"storage": h.store.Ready,
+		"github":  h.client.ping,
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	resp := &healthResponse{Status: "ok", Checks: map[string]*checkResult{}}
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check(ctx)
+			result := &checkResult{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				result.Status = "unavailable"
+				result.Error = err.Error()
+				requestLogger(r.Context()).Warn("readiness check failed", "check", name, "error", redactURL(err))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[name] = result
+			if err != nil {
+				resp.Status = "unavailable"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
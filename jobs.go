@@ -0,0 +1,270 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrJobNotFound is returned when a job does not exist
+	ErrJobNotFound = errors.New("job does not exist")
+
+	// ErrQueueFull is returned when no more jobs can be queued
+	ErrQueueFull = errors.New("job queue is full")
+
+	// ErrQueueClosed is returned when jobs are queued during shutdown
+	ErrQueueClosed = errors.New("job queue is closed")
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+const (
+	// queueSize is the number of jobs that can wait for a worker
+	queueSize = 100
+
+	// maxJobs is the number of jobs remembered, oldest finished jobs are
+	// forgotten first
+	maxJobs = 1000
+)
+
+// Job is a unit of background ingestion, such as indexing a repository.
+// Jobs live in memory and are lost on restart.
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Repository string     `json:"repository"`
+	Owner      string     `json:"owner"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	Attempts   int        `json:"attempts"`
+	Created    time.Time  `json:"created"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+
+	run func(ctx context.Context) error
+}
+
+// JobQueue runs jobs on a fixed number of workers
+type JobQueue struct {
+	mu     sync.Mutex
+	jobs   map[string]*Job
+	order  []string
+	queue  chan *Job
+	closed bool
+	wg     sync.WaitGroup
+	log    *slog.Logger
+
+	// ctx is handed to running jobs and cancelled when they could not
+	// finish before shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewJobQueue creates a job queue and starts its workers
+func NewJobQueue(workers int, logger *slog.Logger) *JobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &JobQueue{
+		jobs:   make(map[string]*Job),
+		queue:  make(chan *Job, queueSize),
+		log:    logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue queues run as a job of a Github user
+func (q *JobQueue) Enqueue(owner, kind, repository string, run func(ctx context.Context) error) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	job := &Job{
+		ID:         id,
+		Kind:       kind,
+		Repository: repository,
+		Owner:      owner,
+		State:      JobQueued,
+		Created:    time.Now(),
+		run:        run,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.push(job); err != nil {
+		return Job{}, err
+	}
+	q.jobs[job.ID] = job
+	q.order = append(q.order, job.ID)
+	q.forget()
+	return *job, nil
+}
+
+// Requeue runs a failed job again
+func (q *JobQueue) Requeue(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok || job.State != JobFailed {
+		return Job{}, ErrJobNotFound
+	}
+	if err := q.push(job); err != nil {
+		return Job{}, err
+	}
+	job.State = JobQueued
+	job.Error = ""
+	job.Started, job.Finished = nil, nil
+	return *job, nil
+}
+
+// Get returns a job by id
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List returns the jobs of a Github user, or every job when owner is
+// empty, newest first
+func (q *JobQueue) List(owner string) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := []Job{}
+	for i := len(q.order) - 1; i >= 0; i-- {
+		job := q.jobs[q.order[i]]
+		if owner == "" || job.Owner == owner {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs
+}
+
+// Depth returns the number of jobs waiting for a worker
+func (q *JobQueue) Depth() int {
+	return len(q.queue)
+}
+
+// Close stops accepting jobs and waits for queued and running jobs to
+// finish. When ctx is done first, running jobs are cancelled and queued
+// ones fail without running.
+func (q *JobQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+// push hands a job to the workers without blocking. The lock must be held.
+func (q *JobQueue) push(job *Job) error {
+	if q.closed {
+		return ErrQueueClosed
+	}
+	select {
+	case q.queue <- job:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// forget drops the oldest finished jobs beyond maxJobs. The lock must be
+// held.
+func (q *JobQueue) forget() {
+	for i := 0; len(q.order) > maxJobs && i < len(q.order); {
+		job := q.jobs[q.order[i]]
+		if job.State != JobSucceeded && job.State != JobFailed {
+			i++
+			continue
+		}
+		delete(q.jobs, job.ID)
+		q.order = append(q.order[:i], q.order[i+1:]...)
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+	for job := range q.queue {
+		q.update(job, func() {
+			now := time.Now()
+			job.State = JobRunning
+			job.Started = &now
+			job.Attempts++
+		})
+
+		err := q.ctx.Err()
+		if err == nil {
+			err = job.run(q.ctx)
+		}
+
+		var finished Job
+		q.update(job, func() {
+			now := time.Now()
+			job.Finished = &now
+			if err != nil {
+				job.State = JobFailed
+				job.Error = redactURL(err).Error()
+			} else {
+				job.State = JobSucceeded
+			}
+			finished = *job
+		})
+		jobsFinished.WithLabelValues(finished.Kind, finished.State).Inc()
+		q.logJob(finished)
+	}
+}
+
+// logJob logs the outcome of a finished job
+func (q *JobQueue) logJob(job Job) {
+	attrs := []any{
+		"job", job.ID,
+		"kind", job.Kind,
+		"repository", job.Repository,
+		"user", job.Owner,
+		"attempts", job.Attempts,
+		"duration", job.Finished.Sub(*job.Started),
+	}
+	if job.State == JobFailed {
+		q.log.Error("job failed", append(attrs, "error", job.Error)...)
+		return
+	}
+	q.log.Info("job succeeded", attrs...)
+}
+
+func (q *JobQueue) update(job *Job, fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn()
+}
@@ -0,0 +1,109 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the id of a request, from a proxy in front of the
+// app or back to the client
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern matches request ids accepted from clients
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// probePaths are polled by orchestrators, their successful requests are only
+// logged at debug level
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// loggerKey is the context key of the logger of a request
+type loggerKey struct{}
+
+// statusRecorder remembers the status written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streamed responses such as exports reach the client
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// traceRequests tags every request with an id, hands handlers a logger
+// carrying it and logs the outcome of the request. Users are logged by the
+// key derived from their token, never by the token itself, and query
+// strings are left out as they can hold OAuth codes.
+func (h *Handler) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			if id, err = newID(); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := h.log.With("request_id", id)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+		}
+		if token := currentUser(r); token != "" {
+			attrs = append(attrs, "user", userKey(token))
+		}
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if probePaths[r.URL.Path] {
+			level = slog.LevelDebug
+		}
+		logger.Log(r.Context(), level, "request", attrs...)
+	})
+}
+
+// redactURL leaves the query string and user info out of the URL an error
+// names, as they can hold OAuth codes and secrets, before it is logged
+func redactURL(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	redacted := "[redacted]"
+	if u, perr := url.Parse(urlErr.URL); perr == nil {
+		u.User, u.RawQuery, u.Fragment = nil, "", ""
+		redacted = u.String()
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), urlErr.URL, redacted))
+}
+
+// requestLogger returns the logger of a request, or the default logger
+// outside of one
+func requestLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
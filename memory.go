@@ -0,0 +1,624 @@
+package search
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements Storage in memory, for tests and for trying
+// git_engine without a database. Searches match n-grams like BoltStore.
+// Nothing survives a restart.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	// lists holds the repository list of every user by repository id, nil
+	// until the list is created
+	lists      map[string]map[int]*Repository
+	commits    map[string][]*IndexCommit
+	pulls      map[string][]*IndexPullRequest
+	details    map[string]*CommitDetail
+	branches   map[string][]string
+	searches   map[string]*SavedSearch
+	workspaces map[string]*Workspace
+	users      map[string]*userRecord
+	audit      []*AuditEvent
+
+	log *slog.Logger
+}
+
+// NewMemoryStore creates an empty store logging to logger
+func NewMemoryStore(logger *slog.Logger) *MemoryStore {
+	return &MemoryStore{
+		lists:      make(map[string]map[int]*Repository),
+		commits:    make(map[string][]*IndexCommit),
+		pulls:      make(map[string][]*IndexPullRequest),
+		details:    make(map[string]*CommitDetail),
+		branches:   make(map[string][]string),
+		searches:   make(map[string]*SavedSearch),
+		workspaces: make(map[string]*Workspace),
+		users:      make(map[string]*userRecord),
+		log:        logger,
+	}
+}
+
+// UserExist checks if a user has already been created
+func (s *MemoryStore) UserExist(ctx context.Context, token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.lists[token]
+	return ok
+}
+
+// CreateUserIndex creates a user without a repository list
+func (s *MemoryStore) CreateUserIndex(ctx context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lists[token]; !ok {
+		s.lists[token] = nil
+	}
+	return nil
+}
+
+// CreateRepositoryList adds or refreshes a repository in the repository list
+func (s *MemoryStore) CreateRepositoryList(ctx context.Context, token string, r *Repository) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, ok := s.lists[token]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if list == nil {
+		list = make(map[int]*Repository)
+		s.lists[token] = list
+	}
+
+	// Keep the active status of a repository already listed
+	repo := *r
+	if existing, ok := list[r.ID]; ok {
+		repo.Active = repo.Active || existing.Active
+	}
+	list[r.ID] = &repo
+	return nil
+}
+
+// ActivateRepository activates a repository by its full name
+func (s *MemoryStore) ActivateRepository(ctx context.Context, token, fullName string) error {
+	return s.setActive(token, fullName, true)
+}
+
+// DeactivateRepository deactivates a repository by its full name
+func (s *MemoryStore) DeactivateRepository(ctx context.Context, token, fullName string) error {
+	return s.setActive(token, fullName, false)
+}
+
+// setActive sets the active status of a repository in the repository list
+func (s *MemoryStore) setActive(token, fullName string, active bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.repositoryList(token)
+	if err != nil {
+		return err
+	}
+	for _, repo := range list {
+		if repo.FullName == fullName {
+			repo.Active = active
+			return nil
+		}
+	}
+	return ErrRepoNotFound
+}
+
+// RepoExists checks if the commits of a repository have been indexed
+func (s *MemoryStore) RepoExists(ctx context.Context, fullName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.commits[fullName]
+	return ok
+}
+
+// CreateRepository indexes commits for a repository under its full name,
+// replacing the commits indexed before
+func (s *MemoryStore) CreateRepository(ctx context.Context, fullName string, commits []*GitCommit) ([]*IndexCommit, error) {
+	s.mu.Lock()
+	known := make(map[string]bool)
+	for _, commit := range s.commits[fullName] {
+		known[commit.SHA] = true
+	}
+	rows := make([]*IndexCommit, 0, len(commits))
+	var added []*IndexCommit
+	for _, commit := range commits {
+		row := newIndexCommit(fullName, commit)
+		rows = append(rows, row)
+		if !known[commit.SHA] {
+			added = append(added, row)
+		}
+	}
+	s.commits[fullName] = rows
+	s.mu.Unlock()
+
+	commitsIndexed.WithLabelValues(fullName).Add(float64(len(commits)))
+	s.log.Info("indexed commits", "repository", fullName, "count", len(commits), "added", len(added))
+	return added, nil
+}
+
+// GetCommits returns commits for a given repository sharing a term with
+// the query, best matches first then newest first. Without a term every
+// commit passing the filters matches.
+func (s *MemoryStore) GetCommits(ctx context.Context, fullName string, q *SearchQuery) ([]*IndexCommit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, ok := s.commits[fullName]
+	if !ok {
+		return nil, ErrRepoNotFound
+	}
+
+	scores := make(map[string]int)
+	var commits []*IndexCommit
+	for _, row := range rows {
+		score := termScore(row.searchable(), q.Term)
+		if (q.Term != "" && score == 0) || !q.Matches(row) {
+			continue
+		}
+		commit := *row
+		scores[commit.SHA] = score
+		commits = append(commits, &commit)
+	}
+	sort.Slice(commits, func(i, j int) bool {
+		if scores[commits[i].SHA] != scores[commits[j].SHA] {
+			return scores[commits[i].SHA] > scores[commits[j].SHA]
+		}
+		return newerCommit(commits[i], commits[j])
+	})
+	return resultPage(commits, q), nil
+}
+
+// CountCommits counts the matching commits of a repository
+func (s *MemoryStore) CountCommits(ctx context.Context, fullName string, q *SearchQuery) (int, error) {
+	commits, err := s.GetCommits(ctx, fullName, q.unpaged())
+	return len(commits), err
+}
+
+// ScrollCommits calls fn for every matching commit, newest first
+func (s *MemoryStore) ScrollCommits(ctx context.Context, fullName string, q *SearchQuery, fn func(*IndexCommit) error) error {
+	commits, err := s.GetCommits(ctx, fullName, q.unpaged())
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(commits, func(i, j int) bool { return commits[i].Date.After(commits[j].Date) })
+	for _, commit := range commits {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(commit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreatePullRequests indexes the pull requests and review comments of a
+// repository, replacing those indexed before
+func (s *MemoryStore) CreatePullRequests(ctx context.Context, fullName string, pulls []*GitPullRequest, comments []*GitReviewComment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pulls[fullName] = newIndexPullRequests(fullName, pulls, comments)
+	return nil
+}
+
+// GetPullRequests searches the pull requests and review comments of a
+// repository, best matches first
+func (s *MemoryStore) GetPullRequests(ctx context.Context, fullName string, q *SearchQuery) ([]*IndexPullRequest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scores := make(map[string]int)
+	var pulls []*IndexPullRequest
+	for _, doc := range s.pulls[fullName] {
+		score := termScore(doc.searchable(), q.Term)
+		if (q.Term != "" && score == 0) || !q.Wants(doc.Type) {
+			continue
+		}
+		pull := *doc
+		scores[pull.id] = score
+		pulls = append(pulls, &pull)
+	}
+	sort.Slice(pulls, func(i, j int) bool {
+		if scores[pulls[i].id] != scores[pulls[j].id] {
+			return scores[pulls[i].id] > scores[pulls[j].id]
+		}
+		return pulls[i].id < pulls[j].id
+	})
+	return resultPage(pulls, q), nil
+}
+
+// CountPullRequests counts the matching pull requests and review comments
+func (s *MemoryStore) CountPullRequests(ctx context.Context, fullName string, q *SearchQuery) (int, error) {
+	pulls, err := s.GetPullRequests(ctx, fullName, q.unpaged())
+	return len(pulls), err
+}
+
+// SaveCommitDetail stores the details of a commit
+func (s *MemoryStore) SaveCommitDetail(ctx context.Context, detail *CommitDetail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *detail
+	s.details[commitID(detail.Repository, detail.SHA)] = &stored
+	return nil
+}
+
+// GetCommitDetail retrieves the stored details of a commit
+func (s *MemoryStore) GetCommitDetail(ctx context.Context, fullName, sha string) (*CommitDetail, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	detail, ok := s.details[commitID(fullName, sha)]
+	if !ok {
+		return nil, ErrCommitNotFound
+	}
+	found := *detail
+	return &found, nil
+}
+
+// SetBranches chooses the branches indexed for a repository
+func (s *MemoryStore) SetBranches(ctx context.Context, fullName string, branches []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.branches[fullName] = append([]string(nil), branches...)
+	return nil
+}
+
+// GetBranches returns the branches indexed for a repository
+func (s *MemoryStore) GetBranches(ctx context.Context, fullName string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.branches[fullName]...), nil
+}
+
+// GetRepositories suggests repositories starting with search
+func (s *MemoryStore) GetRepositories(ctx context.Context, token, search string) ([]*Repository, error) {
+	prefix := strings.ToLower(search)
+	repos, err := s.listRepositories(token, func(repo *Repository) bool {
+		return strings.HasPrefix(strings.ToLower(repo.Name), prefix) ||
+			strings.HasPrefix(strings.ToLower(repo.FullName), prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(repos) > suggestSize {
+		repos = repos[:suggestSize]
+	}
+	return repos, nil
+}
+
+// GetRepository looks up a repository in the repository list
+func (s *MemoryStore) GetRepository(ctx context.Context, token, fullName string) (*Repository, error) {
+	repos, err := s.listRepositories(token, func(repo *Repository) bool { return repo.FullName == fullName })
+	if err != nil {
+		return nil, err
+	} else if len(repos) == 0 {
+		return nil, ErrRepoNotFound
+	}
+	return repos[0], nil
+}
+
+// GetActiveRepositories retrieves active repositories
+func (s *MemoryStore) GetActiveRepositories(ctx context.Context, token string) ([]*Repository, error) {
+	return s.listRepositories(token, func(repo *Repository) bool { return repo.Active })
+}
+
+// CountActiveRepositories counts the active repositories of every user
+func (s *MemoryStore) CountActiveRepositories(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, list := range s.lists {
+		for _, repo := range list {
+			if repo.Active {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// SaveSearch creates or replaces a saved search
+func (s *MemoryStore) SaveSearch(ctx context.Context, ss *SavedSearch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *ss
+	s.searches[ss.ID] = &stored
+	return nil
+}
+
+// GetSearch retrieves a saved search by id
+func (s *MemoryStore) GetSearch(ctx context.Context, id string) (*SavedSearch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ss, ok := s.searches[id]
+	if !ok {
+		return nil, ErrSearchNotFound
+	}
+	found := *ss
+	return &found, nil
+}
+
+// GetSearches lists the saved searches of a Github user
+func (s *MemoryStore) GetSearches(ctx context.Context, login string) ([]*SavedSearch, error) {
+	return s.savedSearches(func(ss *SavedSearch) bool { return ss.Owner == login }), nil
+}
+
+// DeleteSearch removes a saved search
+func (s *MemoryStore) DeleteSearch(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.searches[id]; !ok {
+		return ErrSearchNotFound
+	}
+	delete(s.searches, id)
+	return nil
+}
+
+// MatchSearches runs the saved searches of a repository against new
+// commits, matching terms the way GetCommits does
+func (s *MemoryStore) MatchSearches(ctx context.Context, fullName string, commits []*IndexCommit) ([]*Alert, error) {
+	var alerts []*Alert
+	for _, ss := range s.savedSearches(func(ss *SavedSearch) bool { return ss.Repository == fullName }) {
+		alert := &Alert{Search: ss}
+		q := ss.Query()
+		for _, commit := range commits {
+			if q.Matches(commit) && matchesTerm(commit.searchable(), q.Term) {
+				alert.Commits = append(alert.Commits, commit)
+			}
+		}
+		if len(alert.Commits) > 0 {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts, nil
+}
+
+// SaveWorkspace creates or replaces a workspace
+func (s *MemoryStore) SaveWorkspace(ctx context.Context, ws *Workspace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *ws
+	s.workspaces[ws.ID] = &stored
+	return nil
+}
+
+// GetWorkspace retrieves a workspace by id
+func (s *MemoryStore) GetWorkspace(ctx context.Context, id string) (*Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ws, ok := s.workspaces[id]
+	if !ok {
+		return nil, ErrWorkspaceNotFound
+	}
+	found := *ws
+	return &found, nil
+}
+
+// AddWorkspaceMember adds a Github user to a workspace
+func (s *MemoryStore) AddWorkspaceMember(ctx context.Context, id, login string) error {
+	return s.updateWorkspace(id, func(ws *Workspace) bool { return ws.addMember(login) })
+}
+
+// AddWorkspaceRepository adds a repository to a workspace
+func (s *MemoryStore) AddWorkspaceRepository(ctx context.Context, id, fullName string) error {
+	return s.updateWorkspace(id, func(ws *Workspace) bool { return ws.addRepository(fullName) })
+}
+
+// updateWorkspace changes a copy of a workspace under the lock, so readers
+// never see it half changed
+func (s *MemoryStore) updateWorkspace(id string, change func(*Workspace) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ws, ok := s.workspaces[id]
+	if !ok {
+		return ErrWorkspaceNotFound
+	}
+	changed := *ws
+	changed.Members = append([]string(nil), ws.Members...)
+	changed.Repositories = append([]string(nil), ws.Repositories...)
+	if change(&changed) {
+		s.workspaces[id] = &changed
+	}
+	return nil
+}
+
+// GetWorkspaces retrieves the workspaces a Github user is a member of
+func (s *MemoryStore) GetWorkspaces(ctx context.Context, login string) ([]*Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []*Workspace
+	for _, ws := range s.workspaces {
+		if ws.HasMember(login) {
+			member := *ws
+			found = append(found, &member)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	return found, nil
+}
+
+// SaveLogin records the Github login of a user as they sign in
+func (s *MemoryStore) SaveLogin(ctx context.Context, token, login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[userKey(token)] = &userRecord{Key: userKey(token), Login: login, LastLogin: time.Now().UTC()}
+	return nil
+}
+
+// GetUsers lists every user, their login and active repositories
+func (s *MemoryStore) GetUsers(ctx context.Context) ([]*UserSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []*UserSummary{}
+	for token, list := range s.lists {
+		user := &UserSummary{Key: userKey(token), Repositories: []string{}}
+		if record, ok := s.users[user.Key]; ok {
+			lastLogin := record.LastLogin
+			user.Login, user.LastLogin = record.Login, &lastLogin
+		}
+		for _, repo := range list {
+			if repo.Active {
+				user.Repositories = append(user.Repositories, repo.FullName)
+			}
+		}
+		sort.Strings(user.Repositories)
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Key < users[j].Key })
+	return users, nil
+}
+
+// DeleteUser removes the repository list and login of a user, their saved
+// searches and their membership of workspaces
+func (s *MemoryStore) DeleteUser(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for token := range s.lists {
+		if userKey(token) == key {
+			delete(s.lists, token)
+			found = true
+		}
+	}
+	if !found {
+		return ErrUserNotFound
+	}
+	record, ok := s.users[key]
+	if !ok {
+		return nil
+	}
+	delete(s.users, key)
+	for id, ss := range s.searches {
+		if ss.Owner == record.Login {
+			delete(s.searches, id)
+		}
+	}
+	for _, ws := range s.workspaces {
+		ws.Members = without(ws.Members, record.Login)
+	}
+	return nil
+}
+
+// GetStats counts the documents held in memory. Their size is not tracked.
+func (s *MemoryStore) GetStats(ctx context.Context) (*StorageStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	memory := &IndexStats{Name: "memory"}
+	repos := make(map[string]*RepositoryStats)
+	stats := func(fullName string) *RepositoryStats {
+		if repos[fullName] == nil {
+			repos[fullName] = &RepositoryStats{Repository: fullName}
+		}
+		return repos[fullName]
+	}
+	for fullName, commits := range s.commits {
+		stats(fullName).Commits = int64(len(commits))
+		memory.Documents += int64(len(commits))
+	}
+	for fullName, docs := range s.pulls {
+		rs := stats(fullName)
+		for _, doc := range docs {
+			if doc.Type == DocPullRequest {
+				rs.PullRequests++
+			}
+		}
+		memory.Documents += int64(len(docs))
+	}
+	return &StorageStats{Indices: []*IndexStats{memory}, Repositories: repositoryStats(repos)}, nil
+}
+
+// AppendAudit records an event in the audit log
+func (s *MemoryStore) AppendAudit(ctx context.Context, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *event
+	s.audit = append(s.audit, &stored)
+	return nil
+}
+
+// GetAuditEvents lists the latest events of the audit log matching a
+// query, newest first
+func (s *MemoryStore) GetAuditEvents(ctx context.Context, q *AuditQuery) ([]*AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	events := []*AuditEvent{}
+	for i := len(s.audit) - 1; i >= 0 && len(events) < q.Limit; i-- {
+		if !q.Matches(s.audit[i]) {
+			continue
+		}
+		event := *s.audit[i]
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+// Ready always succeeds, memory needs no connection
+func (s *MemoryStore) Ready(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, the data goes with the process
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Reindex has nothing to migrate, memory holds no older schema
+func (s *MemoryStore) Reindex(ctx context.Context, fetch CommitFetcher) error {
+	return nil
+}
+
+// repositoryList returns the repository list of a user. Callers hold s.mu.
+func (s *MemoryStore) repositoryList(token string) (map[int]*Repository, error) {
+	list, ok := s.lists[token]
+	if !ok {
+		return nil, ErrUserNotFound
+	} else if list == nil {
+		return nil, ErrRepoTypeMissing
+	}
+	return list, nil
+}
+
+// listRepositories returns copies of the repositories of a user kept by
+// keep, sorted by name
+func (s *MemoryStore) listRepositories(token string, keep func(*Repository) bool) ([]*Repository, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list, err := s.repositoryList(token)
+	if err != nil {
+		return nil, err
+	}
+	var repos []*Repository
+	for _, repo := range list {
+		if keep(repo) {
+			found := *repo
+			repos = append(repos, &found)
+		}
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		if repos[i].Name != repos[j].Name {
+			return repos[i].Name < repos[j].Name
+		}
+		return repos[i].FullName < repos[j].FullName
+	})
+	return repos, nil
+}
+
+func (s *MemoryStore) savedSearches(keep func(*SavedSearch) bool) []*SavedSearch {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []*SavedSearch
+	for _, ss := range s.searches {
+		if keep(ss) {
+			search := *ss
+			found = append(found, &search)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	return found
+}
@@ -0,0 +1,358 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger discards the logs of the code under test
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testStores opens an empty store of each embedded Storage, so MemoryStore
+// is held to the behaviour of BoltStore
+var testStores = map[string]func(t *testing.T) Storage{
+	"memory": func(t *testing.T) Storage {
+		return NewMemoryStore(testLogger)
+	},
+	"bolt": func(t *testing.T) Storage {
+		store, err := NewBoltStore(filepath.Join(t.TempDir(), "git_engine.db"), testLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	},
+}
+
+// testCommits returns four commits of octocat/hello-world, one a day, the
+// last of them only on the feature branch. Their SHAs are not in date
+// order, so tests tell the two orders apart.
+func testCommits() []*GitCommit {
+	start := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	commit := func(sha, message string, day int, branches, tags []string) *GitCommit {
+		return &GitCommit{
+			SHA: sha,
+			Commit: &Commit{
+				Message: message,
+				Author:  &Signature{Name: "The Octocat", Date: start.AddDate(0, 0, day)},
+			},
+			Author:   &User{Username: "octocat"},
+			Branches: branches,
+			Tags:     tags,
+		}
+	}
+	return []*GitCommit{
+		commit("4e1d", "Initial commit", 0, []string{"main"}, []string{"v1.0"}),
+		commit("2f0a", "Fix greeting typo", 1, []string{"main"}, []string{"v1.0"}),
+		commit("9b3c", "Add greeting flags", 2, []string{"main", "feature"}, nil),
+		commit("1c7e", "Experiment with colours", 3, []string{"feature"}, nil),
+	}
+}
+
+func shas(commits []*IndexCommit) []string {
+	found := []string{}
+	for _, commit := range commits {
+		found = append(found, commit.SHA)
+	}
+	return found
+}
+
+func TestStorageGetCommits(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *SearchQuery
+		want  []string
+	}{
+		{"every commit", &SearchQuery{}, []string{"1c7e", "9b3c", "2f0a", "4e1d"}},
+		{"term", &SearchQuery{Term: "greeting"}, []string{"9b3c", "2f0a"}},
+		{"partial term", &SearchQuery{Term: "greet"}, []string{"9b3c", "2f0a"}},
+		{"best match first", &SearchQuery{Term: "greeting typo"}, []string{"2f0a", "9b3c"}},
+		{"no match", &SearchQuery{Term: "zebra"}, []string{}},
+		{"branch", &SearchQuery{Branch: "feature"}, []string{"1c7e", "9b3c"}},
+		{"tag", &SearchQuery{Term: "greeting", Tag: "v1.0"}, []string{"2f0a"}},
+		{"page", &SearchQuery{From: 1, Size: 2}, []string{"9b3c", "2f0a"}},
+		{"page past the end", &SearchQuery{From: 8, Size: 2}, []string{}},
+	}
+	for name, newStore := range testStores {
+		ctx := context.Background()
+		store := newStore(t)
+		if _, err := store.CreateRepository(ctx, "octocat/hello-world", testCommits()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				commits, err := store.GetCommits(ctx, "octocat/hello-world", tt.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := shas(commits); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("GetCommits() = %v, want %v", got, tt.want)
+				}
+				count, err := store.CountCommits(ctx, "octocat/hello-world", tt.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if unpaged, _ := store.GetCommits(ctx, "octocat/hello-world", tt.query.unpaged()); count != len(unpaged) {
+					t.Errorf("CountCommits() = %d, want %d", count, len(unpaged))
+				}
+			})
+		}
+		t.Run(name+"/unknown repository", func(t *testing.T) {
+			if _, err := store.GetCommits(ctx, "octocat/nope", &SearchQuery{}); !errors.Is(err, ErrRepoNotFound) {
+				t.Errorf("GetCommits() error = %v, want %v", err, ErrRepoNotFound)
+			}
+		})
+	}
+}
+
+func TestStorageScrollCommits(t *testing.T) {
+	errStop := errors.New("stop")
+	tests := []struct {
+		name    string
+		query   *SearchQuery
+		stopAt  int
+		want    []string
+		wantErr error
+	}{
+		{"newest first", &SearchQuery{}, 0, []string{"1c7e", "9b3c", "2f0a", "4e1d"}, nil},
+		{"ignores the page", &SearchQuery{From: 1, Size: 1}, 0, []string{"1c7e", "9b3c", "2f0a", "4e1d"}, nil},
+		{"term", &SearchQuery{Term: "greeting"}, 0, []string{"9b3c", "2f0a"}, nil},
+		{"stops on error", &SearchQuery{}, 2, []string{"1c7e", "9b3c"}, errStop},
+	}
+	for name, newStore := range testStores {
+		ctx := context.Background()
+		store := newStore(t)
+		if _, err := store.CreateRepository(ctx, "octocat/hello-world", testCommits()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				got := []string{}
+				err := store.ScrollCommits(ctx, "octocat/hello-world", tt.query, func(commit *IndexCommit) error {
+					got = append(got, commit.SHA)
+					if len(got) == tt.stopAt {
+						return errStop
+					}
+					return nil
+				})
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ScrollCommits() error = %v, want %v", err, tt.wantErr)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ScrollCommits() visited %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStorageDeleteUser(t *testing.T) {
+	const octocat, hubot = "gho_octocat", "gho_hubot"
+	tests := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{"signed in user", userKey(octocat), nil},
+		{"unknown user", userKey("gho_nobody"), ErrUserNotFound},
+	}
+	for name, newStore := range testStores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				store := newStore(t)
+				for token, login := range map[string]string{octocat: "octocat", hubot: "hubot"} {
+					if err := store.CreateUserIndex(ctx, token); err != nil {
+						t.Fatal(err)
+					}
+					if err := store.SaveLogin(ctx, token, login); err != nil {
+						t.Fatal(err)
+					}
+				}
+				ss := &SavedSearch{ID: "typos", Name: "Typos", Owner: "octocat", Repository: "octocat/hello-world", Term: "typo"}
+				if err := store.SaveSearch(ctx, ss); err != nil {
+					t.Fatal(err)
+				}
+				ws := &Workspace{ID: "team", Name: "Team", Owner: "hubot", Members: []string{"hubot", "octocat"}, Repositories: []string{}}
+				if err := store.SaveWorkspace(ctx, ws); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := store.DeleteUser(ctx, tt.key); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DeleteUser() error = %v, want %v", err, tt.wantErr)
+				}
+				deleted := tt.wantErr == nil
+
+				// Only the deleted user's account, searches and
+				// memberships are gone
+				if exists := store.UserExist(ctx, octocat); exists == deleted {
+					t.Errorf("UserExist(octocat) = %v, want %v", exists, !deleted)
+				}
+				if !store.UserExist(ctx, hubot) {
+					t.Error("UserExist(hubot) = false, want true")
+				}
+				if _, err := store.GetSearch(ctx, ss.ID); deleted != errors.Is(err, ErrSearchNotFound) {
+					t.Errorf("GetSearch() error = %v, search deleted %v", err, deleted)
+				}
+				got, err := store.GetWorkspace(ctx, ws.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.HasMember("octocat") == deleted || !got.HasMember("hubot") {
+					t.Errorf("workspace members = %v", got.Members)
+				}
+				users, err := store.GetUsers(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := 2
+				if deleted {
+					want = 1
+				}
+				if len(users) != want {
+					t.Errorf("GetUsers() = %d users, want %d", len(users), want)
+				}
+			})
+		}
+	}
+}
+
+func TestStorageActivation(t *testing.T) {
+	const token = "gho_octocat"
+	tests := []struct {
+		name       string
+		deactivate string
+		wantErr    error
+		wantActive []string
+	}{
+		{"deactivate", "octocat/hello-world", nil, []string{"octocat/secret"}},
+		{"deactivate inactive", "octo-org/tools", nil, []string{"octocat/hello-world", "octocat/secret"}},
+		{"unknown repository", "octocat/nope", ErrRepoNotFound, []string{"octocat/hello-world", "octocat/secret"}},
+	}
+	for name, newStore := range testStores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				store := newStore(t)
+				if err := store.CreateUserIndex(ctx, token); err != nil {
+					t.Fatal(err)
+				}
+				for i, fullName := range []string{"octocat/hello-world", "octocat/secret", "octo-org/tools"} {
+					if err := store.CreateRepositoryList(ctx, token, &Repository{ID: i + 1, FullName: fullName}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for _, fullName := range []string{"octocat/hello-world", "octocat/secret"} {
+					if err := store.ActivateRepository(ctx, token, fullName); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err := store.DeactivateRepository(ctx, token, tt.deactivate); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DeactivateRepository() error = %v, want %v", err, tt.wantErr)
+				}
+				repos, err := store.GetActiveRepositories(ctx, token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				active := []string{}
+				for _, repo := range repos {
+					active = append(active, repo.FullName)
+				}
+				sort.Strings(active)
+				if !reflect.DeepEqual(active, tt.wantActive) {
+					t.Errorf("GetActiveRepositories() = %v, want %v", active, tt.wantActive)
+				}
+			})
+		}
+	}
+}
+
+func TestStorageSearchToken(t *testing.T) {
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			ss := &SavedSearch{ID: "typos", Owner: "octocat", Repository: "octocat/hello-world", Term: "typo", token: "gho_octocat"}
+			if err := store.SaveSearch(ctx, ss); err != nil {
+				t.Fatal(err)
+			}
+
+			// The owner's token is kept for checking their access, but
+			// never sent with the search
+			got, err := store.GetSearch(ctx, ss.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.token != ss.token {
+				t.Errorf("GetSearch() token = %q, want %q", got.token, ss.token)
+			}
+			alerts, err := store.MatchSearches(ctx, ss.Repository, []*IndexCommit{{SHA: "2f0a", Message: "Fix greeting typo"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(alerts) != 1 || alerts[0].Search.token != ss.token {
+				t.Fatalf("MatchSearches() = %d alerts, want one carrying the owner's token", len(alerts))
+			}
+			body, err := json.Marshal(alerts[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(body), ss.token) {
+				t.Errorf("alert %s holds the owner's token", body)
+			}
+		})
+	}
+}
+
+func TestStorageAddWorkspaceMember(t *testing.T) {
+	logins := []string{"hubot", "monalisa", "defunkt", "mojombo"}
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			ws := &Workspace{ID: "team", Name: "Team", Owner: "octocat", Members: []string{"octocat"}, Repositories: []string{}}
+			if err := store.SaveWorkspace(ctx, ws); err != nil {
+				t.Fatal(err)
+			}
+
+			// Members invited at once are all kept, and once each
+			var wg sync.WaitGroup
+			for _, login := range append(logins, logins...) {
+				wg.Add(1)
+				go func(login string) {
+					defer wg.Done()
+					if err := store.AddWorkspaceMember(ctx, ws.ID, login); err != nil {
+						t.Error(err)
+					}
+				}(login)
+			}
+			wg.Wait()
+			got, err := store.GetWorkspace(ctx, ws.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			members := append([]string(nil), got.Members...)
+			sort.Strings(members)
+			want := append([]string{"octocat"}, logins...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(members, want) {
+				t.Errorf("members = %v, want %v", members, want)
+			}
+
+			if err := store.AddWorkspaceMember(ctx, "nope", "hubot"); !errors.Is(err, ErrWorkspaceNotFound) {
+				t.Errorf("AddWorkspaceMember() error = %v, want %v", err, ErrWorkspaceNotFound)
+			}
+		})
+	}
+}
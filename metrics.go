@@ -0,0 +1,199 @@
+package search
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes the name of every metric
+const metricsNamespace = "git_engine"
+
+// ErrMetricsDisabled is returned by /metrics when no bearer token is
+// configured for it
+var ErrMetricsDisabled = errors.New("metrics are disabled without a token")
+
+// Metrics shared by every Handler, Client and Store. They are registered
+// in the registry of each Handler.
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by route template, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	githubRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_requests_total",
+		Help:      "Requests sent to the Github API by response status, error when none was received.",
+	}, []string{"status"})
+
+	githubRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_request_duration_seconds",
+		Help:      "Duration of requests sent to the Github API.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	githubRateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "Github API requests left in the current rate limit window of the user with the fewest left.",
+	})
+
+	elasticRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "elasticsearch_request_duration_seconds",
+		Help:      "Duration of Elasticsearch requests by API endpoint and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "status"})
+
+	commitsIndexed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commits_indexed_total",
+		Help:      "Commits written to storage by repository.",
+	}, []string{"repository"})
+
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_finished_total",
+		Help:      "Background jobs finished by kind and state.",
+	}, []string{"kind", "state"})
+)
+
+var (
+	activeRepositoriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "active_repositories"),
+		"Repositories activated in a repository list, counted once per user.",
+		nil, nil,
+	)
+	jobQueueDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "job_queue_depth"),
+		"Background jobs waiting for a worker.",
+		nil, nil,
+	)
+)
+
+// stateCollector reads gauges from the store and the job queue when
+// metrics are scraped
+type stateCollector struct {
+	store Storage
+	jobs  *JobQueue
+	log   *slog.Logger
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeRepositoriesDesc
+	ch <- jobQueueDepthDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(jobQueueDepthDesc, prometheus.GaugeValue, float64(c.jobs.Depth()))
+
+	// Leave the gauge out rather than report a wrong count
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	count, err := c.store.CountActiveRepositories(ctx)
+	if err != nil {
+		c.log.Error("counting active repositories failed", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(activeRepositoriesDesc, prometheus.GaugeValue, float64(count))
+}
+
+// newRegistry creates the registry of the metrics served by a handler
+func newRegistry(store Storage, jobs *JobQueue, logger *slog.Logger) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		githubRequests,
+		githubRequestDuration,
+		githubRateLimitRemaining,
+		elasticRequestDuration,
+		commitsIndexed,
+		jobsFinished,
+		&stateCollector{store: store, jobs: jobs, log: logger},
+	)
+	return registry
+}
+
+// getMetricsHandler serves the metrics in the Prometheus text format. Metric
+// labels name repositories, private ones included, so the metrics token is
+// required as a bearer token and nothing is served without one.
+func (h *Handler) getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.metricsToken == "" {
+		writeError(w, r, ErrMetricsDisabled)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.metricsToken)) != 1 {
+		writeError(w, r, ErrNoSession)
+		return
+	}
+	promhttp.HandlerFor(h.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// measureRequests observes the duration of requests by the template of the
+// route they matched, keeping the number of series bounded
+func measureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		httpRequestDuration.
+			WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// elasticTransport observes the latency of requests sent to Elasticsearch
+type elasticTransport struct {
+	next http.RoundTripper
+}
+
+func (t *elasticTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	elasticRequestDuration.
+		WithLabelValues(elasticEndpoint(req.URL.Path), status).
+		Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// elasticEndpoint names the Elasticsearch API of a request path, such as
+// _search or _bulk, leaving out index names and document ids
+func elasticEndpoint(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if strings.HasPrefix(segments[i], "_") {
+			return segments[i]
+		}
+	}
+	if len(segments) == 1 && segments[0] != "" {
+		return "index"
+	}
+	return "other"
+}
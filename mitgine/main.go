@@ -1,13 +1,189 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/amaxwellblair/git_engine"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
-	h := search.NewHandler()
-	r := h.NewRouter()
-	http.ListenAndServe(":9000", r)
+	storage := flag.String("storage", "elastic", "storage backend: elastic, bolt or memory")
+	db := flag.String("db", "git_engine.db", "database file for the bolt storage backend")
+	scopes := flag.String("scopes", strings.Join(search.DefaultScopes, ","), "comma separated Github OAuth scopes requested at login")
+	smtpAddr := flag.String("smtp-addr", "", "host:port of the SMTP server alerts are emailed through")
+	smtpFrom := flag.String("smtp-from", "git_engine@localhost", "sender address of alert emails")
+	smtpUser := flag.String("smtp-user", "", "SMTP username, the password is read from GIT_ENGINE_SMTP_PASSWORD")
+	workers := flag.Int("workers", search.DefaultWorkers, "number of background jobs run at once")
+	logLevel := flag.String("log-level", "info", "lowest level logged: debug, info, warn or error")
+	addr := flag.String("addr", ":9000", "address the server listens on")
+	publicURL := flag.String("public-url", search.DefaultPublicURL, "URL users reach the server at, the OAuth callback is under it")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, served with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	autocertDomains := flag.String("autocert-domains", "", "comma separated domains to get Let's Encrypt certificates for, instead of -tls-cert")
+	autocertCache := flag.String("autocert-cache", "autocert", "directory certificates from Let's Encrypt are kept in")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "longest time reading a request")
+	writeTimeout := flag.Duration("write-timeout", 5*time.Minute, "longest time writing a response, exports included")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "longest time a keep-alive connection waits for a request")
+	githubAPI := flag.String("github-api", search.DefaultGithubAPI, "base URL of the Github API, for Github Enterprise")
+	githubURL := flag.String("github-url", search.DefaultGithubURL, "URL of the Github site serving OAuth logins")
+	githubTimeout := flag.Duration("github-timeout", search.DefaultHTTPTimeout, "longest time a request to Github may take")
+	admins := flag.String("admins", "", "comma separated Github logins allowed into the admin console")
+	shutdownTimeout := flag.Duration("shutdown-timeout", time.Minute, "longest time spent draining requests and jobs on SIGTERM")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		slog.Error("invalid log level", "error", err)
+		os.Exit(2)
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+	apiURL, err := url.Parse(*githubAPI)
+	if err != nil {
+		logger.Error("invalid Github API URL", "error", err)
+		os.Exit(2)
+	}
+	webURL, err := url.Parse(*githubURL)
+	if err != nil {
+		logger.Error("invalid Github URL", "error", err)
+		os.Exit(2)
+	}
+	appURL, err := url.Parse(*publicURL)
+	if err != nil {
+		logger.Error("invalid public URL", "error", err)
+		os.Exit(2)
+	}
+	if (*tlsCert != "" || *autocertDomains != "") && appURL.Scheme != "https" {
+		logger.Error("the public URL must be https when serving TLS", "public_url", *publicURL)
+		os.Exit(2)
+	}
+
+	// Stop waiting for storage, serving requests and running jobs on a
+	// signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	store, err := openStorage(ctx, *storage, *db, logger)
+	if err != nil {
+		logger.Error("opening storage failed", "storage", *storage, "error", err)
+		os.Exit(1)
+	}
+
+	h := search.NewHandler(store, search.Config{
+		Scopes:  strings.Split(*scopes, ","),
+		Workers: *workers,
+		Logger:  logger,
+		Admins:  adminLogins(*admins),
+
+		PublicURL: appURL,
+
+		HTTPClient: &http.Client{Timeout: *githubTimeout},
+		GithubAPI:  apiURL,
+		GithubURL:  webURL,
+
+		MetricsToken: os.Getenv("GIT_ENGINE_METRICS_TOKEN"),
+		SMTP: search.SMTPConfig{
+			Addr:     *smtpAddr,
+			From:     *smtpFrom,
+			Username: *smtpUser,
+			Password: os.Getenv("GIT_ENGINE_SMTP_PASSWORD"),
+		},
+	})
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           h.NewRouter(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	if *autocertDomains != "" {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(*autocertDomains, ",")...),
+			Cache:      autocert.DirCache(*autocertCache),
+		}
+		srv.TLSConfig = m.TLSConfig()
+	}
+
+	// Serve until the server fails or a signal asks to stop
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Info("listening", "addr", srv.Addr, "tls", srv.TLSConfig != nil || *tlsCert != "")
+		switch {
+		case srv.TLSConfig != nil:
+			serveErr <- srv.ListenAndServeTLS("", "")
+		case *tlsCert != "":
+			serveErr <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		default:
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-serveErr:
+		logger.Error("server failed", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+		stop()
+	}
+
+	// Stop accepting requests and drain those in flight, then the
+	// background jobs, before releasing the storage. Jobs still running
+	// after the timeout keep the storage open, as closing it under them
+	// could corrupt it.
+	logger.Info("shutting down", "timeout", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	code := 0
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("draining requests failed", "error", err)
+		code = 1
+	}
+	if err := h.Shutdown(shutdownCtx); err != nil {
+		logger.Error("draining jobs failed, leaving the storage open", "error", err)
+		code = 1
+	} else if err := store.Close(); err != nil {
+		logger.Error("closing storage failed", "error", err)
+		code = 1
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("server failed", "error", err)
+		code = 1
+	}
+	logger.Info("stopped")
+	cancel()
+	os.Exit(code)
+}
+
+// adminLogins splits the -admins flag, an empty flag closes the console
+func adminLogins(flag string) []string {
+	var logins []string
+	for _, login := range strings.Split(flag, ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			logins = append(logins, login)
+		}
+	}
+	return logins
+}
+
+func openStorage(ctx context.Context, backend, path string, logger *slog.Logger) (search.Storage, error) {
+	switch backend {
+	case "bolt":
+		return search.NewBoltStore(path, logger)
+	case "memory":
+		return search.NewMemoryStore(logger), nil
+	}
+	return search.NewElasticStore(ctx, logger)
 }
@@ -0,0 +1,98 @@
+$(document).ready(function () {
+  load_admin();
+});
+
+function load_admin() {
+  get_users();
+  get_stats();
+  get_failed_jobs();
+  get_audit();
+}
+
+function get_users() {
+  $.getJSON("/admin/users", function(resp) {
+    $(".user-holder").empty();
+    $.each(resp.data, function(i, user) {
+      var row = $("<li class='collection-item'>").text(user.login || user.key);
+      if (user.last_login) {
+        $("<span class='repo-badge'>").text("last login " + new Date(user.last_login).toLocaleString()).appendTo(row);
+      }
+      $.each(user.active_repositories, function(j, repo) {
+        $("<span class='repo-badge repo-active'>").text(repo).appendTo(row);
+      });
+      $("<a href='#' class='secondary-content'>delete</a>").click(function() {
+        if (confirm("Delete the data of " + (user.login || user.key) + "?")) {
+          admin_action("DELETE", "/admin/users/" + user.key);
+        }
+        return false;
+      }).appendTo(row);
+      row.appendTo(".user-holder");
+    });
+  });
+}
+
+function get_stats() {
+  $.getJSON("/admin/stats", function(resp) {
+    $(".index-holder, .stats-holder").empty();
+    $.each(resp.data.indices, function(i, index) {
+      $("<li class='collection-item'>").text(index.name + ": " + index.documents + " documents, " + index.bytes + " bytes").appendTo(".index-holder");
+    });
+    $.each(resp.data.repositories, function(i, repo) {
+      var row = $("<li class='collection-item'>").text(repo.repository + ": " + repo.commits + " commits, " + repo.pull_requests + " pull requests");
+      $("<a href='#' class='secondary-content'>resync</a>").click(function() {
+        admin_action("POST", "/admin/repositories/" + repo.repository + "/sync");
+        return false;
+      }).appendTo(row);
+      row.appendTo(".stats-holder");
+    });
+  });
+}
+
+function get_failed_jobs() {
+  $.getJSON("/admin/jobs", { state: "failed" }, function(resp) {
+    $(".job-holder").empty();
+    $.each(resp.data, function(i, job) {
+      var row = $("<li class='collection-item'>").text(job.kind + " " + job.repository + " for " + job.owner + ": " + job.error);
+      $("<a href='#' class='secondary-content'>requeue</a>").click(function() {
+        admin_action("POST", "/admin/jobs/" + job.id + "/requeue");
+        return false;
+      }).appendTo(row);
+      row.appendTo(".job-holder");
+    });
+  });
+}
+
+function get_audit() {
+  var filter = {};
+  $.each($("#audit-filter").serializeArray(), function(i, field) {
+    if (field.value) {
+      filter[field.name] = field.value;
+    }
+  });
+  $.getJSON("/admin/audit", filter, function(resp) {
+    $(".audit-holder").empty();
+    $.each(resp.data, function(i, event) {
+      var text = new Date(event.time).toLocaleString() + " " + (event.login || event.user_key || "anonymous") + " from " + event.ip + " " + event.action;
+      if (event.target) {
+        text += " " + event.target;
+      }
+      if (event.query) {
+        text += " \"" + event.query + "\"";
+      }
+      var row = $("<li class='collection-item'>").text(text);
+      $("<span class='repo-badge'>").text(event.outcome + " " + event.status).toggleClass("repo-active", event.outcome == "succeeded").appendTo(row);
+      row.appendTo(".audit-holder");
+    });
+  });
+}
+
+$("#audit-filter").submit(function() {
+  get_audit();
+  return false;
+});
+
+function admin_action(method, url) {
+  $.ajax({ url: url, method: method }).always(function() {
+    load_admin();
+  });
+}
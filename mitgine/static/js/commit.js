@@ -0,0 +1,59 @@
+$(document).ready(function () {
+  get_commit();
+});
+
+function get_commit() {
+  $.getJSON(commit_url(), function (commit) {
+    put_commit(commit);
+  }).fail(function () {
+    $("#subject").text("Commit not found...");
+  });
+}
+
+function put_commit(commit) {
+  var lines = commit.commit_message.split("\n");
+  $("#subject").text(lines[0]);
+  $("#message").text(lines.slice(1).join("\n").trim());
+  var author = commit.author + " <" + commit.author_email + ">";
+  if (commit.author_login) {
+    author += " (" + commit.author_login + ")";
+  }
+  $("#author").text(author);
+  $("#date").text(new Date(commit.date).toLocaleString());
+  for (var i = 0; i < commit.parents.length; i++) {
+    var sha = commit.parents[i];
+    $("<a class='repo-badge'>").attr("href", repository_url() + "/commits/" + sha).text(sha.substring(0, 7)).appendTo("#parents");
+  }
+  $("#stats").text(commit.files.length + " files, +" + commit.additions + " -" + commit.deletions);
+  $("#github").attr("href", commit.html_url);
+  for (var i = 0; i < commit.files.length; i++) {
+    put_file(commit.files[i]);
+  }
+}
+
+function put_file(file) {
+  var holder = $("<div class='commit-file'>");
+  var header = $("<div class='file-header'>").text(file.filename);
+  $("<span class='repo-badge'>").text(file.status).appendTo(header);
+  $("<span class='repo-badge repo-active'>").text("+" + file.additions + " -" + file.deletions).appendTo(header);
+  header.appendTo(holder);
+  if (file.patch) {
+    var code = $("<code class='language-diff'>").text(file.patch);
+    $("<pre>").append(code).appendTo(holder);
+    hljs.highlightElement(code[0]);
+  } else {
+    $("<div class='pull-body'>").text("Binary or large file, no diff shown").appendTo(holder);
+  }
+  holder.appendTo(".file-holder");
+}
+
+function repository_url() {
+  var bits = document.URL.split("?")[0].split("/");
+  return "http://localhost:9000/dashboard/" + bits[bits.length - 4] + "/" + bits[bits.length - 3];
+}
+
+function commit_url() {
+  return document.URL.split("?")[0];
+}
+
+$("#back").attr("href", repository_url());
@@ -23,7 +23,7 @@ function retrieveActive() {
 }
 
 function activate(repository) {
-  $.post("http://localhost:9000/repositories/activate", { name: repository });
+  $.post("http://localhost:9000/repositories/activate", { full_name: repository });
 }
 
 function load_repos() {
@@ -32,13 +32,35 @@ function load_repos() {
 
 $(function() {
   $( "#repository" ).autocomplete({
-    source: "http://localhost:9000/repositories",
+    source: function( request, response ) {
+      $.getJSON("http://localhost:9000/repositories", { term: request.term }, function(repos) {
+        response($.map(repos, function(repo) {
+          return { label: repo.full_name, value: repo.full_name, repo: repo };
+        }));
+      });
+    },
     minLength: 2,
     select: function( event, ui ) {
+      if (ui.item.repo.active) {
+        return;
+      }
       log( ui.item ?
         ui.item.value :
         "Nothing selected, input was " + this.value );
       activate(ui.item.value);
     }
-  });
+  }).autocomplete( "instance" )._renderItem = function( ul, item ) {
+    var repo = item.repo;
+    var row = $( "<div>" ).text( item.label );
+    if (repo.fork) {
+      $( "<span class='repo-badge'>fork</span>" ).appendTo( row );
+    }
+    if (repo.private) {
+      $( "<span class='repo-badge'>private</span>" ).appendTo( row );
+    }
+    if (repo.active) {
+      $( "<span class='repo-badge repo-active'>already active</span>" ).appendTo( row );
+    }
+    return $( "<li>" ).append( row ).appendTo( ul );
+  };
 });
@@ -7,6 +7,7 @@ function displayNav() {
   var path = url.split("/").pop();
   if (path != "") {
     $("#logout").show();
+    $("#upgrade").show();
     $("#logo").show();
   }
 }
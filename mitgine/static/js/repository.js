@@ -1,3 +1,8 @@
+$(document).ready(function () {
+  get_branches();
+  get_searches();
+});
+
 $('#search').keypress(function (e) {
   if (e.which == 13) {
     var input = $('#search').val();
@@ -7,22 +12,160 @@ $('#search').keypress(function (e) {
   }
 });
 
+$('#branch, #tag, #type').change(function () {
+  clear_log();
+  get_commits($('#search').val());
+});
+
+$('#save_branches').click(function () {
+  var branches = $('#indexed').val() || [];
+  if (branches.length == 0) {
+    return false;
+  }
+  $.ajax({
+    url: branches_url(),
+    type: "POST",
+    data: { branch: branches },
+    traditional: true
+  }).done(function () {
+    get_branches();
+  });
+  return false;
+});
+
+$('.export').click(function () {
+  window.location = export_url($(this).data('format'));
+  return false;
+});
+
+$('#sync').click(function () {
+  $.post(sync_url(), function () {
+    clear_log();
+    get_commits($('#search').val());
+  });
+  return false;
+});
+
+$('#save_search').click(function () {
+  $.post("http://localhost:9000/searches", {
+    name: $('#search_name').val(),
+    full_name: repository(),
+    term: $('#search').val(),
+    branch: $('#branch').val(),
+    tag: $('#tag').val(),
+    webhook: $('#search_webhook').val(),
+    email: $('#search_email').val()
+  }, function () {
+    get_searches();
+  });
+  return false;
+});
+
+function get_searches() {
+  $.getJSON("http://localhost:9000/searches", function (searches) {
+    $(".saved-searches").empty();
+    for (var i = 0; i < searches.length; i++) {
+      if (searches[i].repository == repository()) {
+        log_search(searches[i]);
+      }
+    }
+  });
+}
+
+function log_search(search) {
+  var item = $("<li class='collection-item'>");
+  $("<a href='#'>").text(search.name + ": " + search.term).click(function () {
+    $('#search').val(search.term);
+    $('#branch').val(search.branch || "");
+    $('#tag').val(search.tag || "");
+    clear_log();
+    get_commits(search.term);
+    return false;
+  }).appendTo(item);
+  $("<button class='link-button repo-badge'>").text("delete").click(function () {
+    $.ajax({ url: "http://localhost:9000/searches/" + search.id, type: "DELETE" }).done(get_searches);
+  }).appendTo(item);
+  item.appendTo(".saved-searches");
+}
+
+function get_branches() {
+  $.getJSON(branches_url(), function (refs) {
+    $('#branch, #tag, #indexed').find('option[value!=""]').remove();
+    for (var i = 0; i < refs.indexed.length; i++) {
+      $("<option>").val(refs.indexed[i]).text(refs.indexed[i]).appendTo('#branch');
+    }
+    for (var i = 0; i < refs.tags.length; i++) {
+      $("<option>").val(refs.tags[i]).text(refs.tags[i]).appendTo('#tag');
+    }
+    for (var i = 0; i < refs.branches.length; i++) {
+      var selected = refs.indexed.indexOf(refs.branches[i]) >= 0;
+      $("<option>").val(refs.branches[i]).text(refs.branches[i]).prop('selected', selected).appendTo('#indexed');
+    }
+  });
+}
+
 function get_commits(search) {
-  $.get(commits_url(search), function (data) {
-    var commits = JSON.parse(data);
-    put_commits(commits);
+  $.get(search_url(search), function (data) {
+    var results = JSON.parse(data);
+    if (results.commits.length == 0 && results.pull_requests.length == 0) {
+      no_log();
+      return;
+    }
+    put_commits(results.commits);
+    for (var i = 0; i < results.pull_requests.length; i++) {
+      log_pull(results.pull_requests[i]);
+    }
   });
 }
 
+function log_pull(pull) {
+  var kind = pull.type == "review_comment" ? "review on #" : "pull request #";
+  var item = $("<li class='collection-item'>");
+  $("<span class='repo-badge'>").text(kind + pull.number).appendTo(item);
+  $("<a target='_blank'>").attr("href", pull.html_url).text(" " + pull.title).appendTo(item);
+  if (pull.author) {
+    $("<span class='repo-label'>").text(pull.author).appendTo(item);
+  }
+  $("<div class='pull-body'>").text(pull.body).appendTo(item);
+  item.appendTo(".commit-holder");
+}
+
 function log(commit) {
-  var url = commit["html_url"];
+  var url = "http://localhost:9000/dashboard/" + repository() + "/commits/" + commit["sha"];
   var message = commit["commit_message"];
-  $("<a class='collection-item' target='_blank' href='"+url+"'>"+message+"</a>").text(message).appendTo(".commit-holder");
+  var item = $("<li class='collection-item'>");
+  $("<a>").attr("href", url).text(message).appendTo(item);
+  var branches = commit["branches"] || [];
+  for (var i = 0; i < branches.length; i++) {
+    $("<span class='repo-badge'>").text(branches[i]).appendTo(item);
+  }
+  // Tags are listed newest first, so the last one first shipped the commit
+  var tags = commit["tags"] || [];
+  if (tags.length > 0) {
+    $("<span class='repo-badge repo-active'>").text("first in " + tags[tags.length - 1]).appendTo(item);
+  }
+  var pulls = commit["pull_requests"] || [];
+  for (var i = 0; i < pulls.length; i++) {
+    var pr = pulls[i];
+    var link = $("<a class='repo-badge' target='_blank'>").attr("href", pr.html_url)
+      .text("#" + pr.number + " " + pr.title + " (" + pr.state + ")");
+    var labels = pr.labels || [];
+    for (var j = 0; j < labels.length; j++) {
+      $("<span class='repo-label'>").text(labels[j]).appendTo(link);
+    }
+    link.appendTo(item);
+  }
+  var issues = commit["issues"] || [];
+  for (var i = 0; i < issues.length; i++) {
+    var text = (issues[i].closes ? "fixes #" : "#") + issues[i].number;
+    $("<a class='repo-badge' target='_blank'>").attr("href", issues[i].html_url).text(text).appendTo(item);
+  }
+  item.appendTo(".commit-holder");
   $(".commit-holder").scrollTop(0);
 }
 
 function no_log() {
-  var message = "No commits found...";
+  var message = "Nothing found...";
   $("<li class='collection-item'>"+message+"</li>").text(message).appendTo(".commit-holder");
   $(".commit-holder").scrollTop(0);
 }
@@ -32,17 +175,30 @@ function clear_log() {
 }
 
 function put_commits(commits) {
-  if (commits != null) {
-    for (var i = 0; i < commits.length; i++) {
-      log(commits[i]);
-    }
-  } else {
-      no_log();
+  for (var i = 0; i < commits.length; i++) {
+    log(commits[i]);
   }
 }
 
-function commits_url(term) {
-  var bits = document.URL.split("/");
-  var repo = bits[bits.length - 1];
-  return "http://localhost:9000/dashboard/"+repo+"/commits?term="+term;
+function repository() {
+  var bits = document.URL.split("?")[0].split("/");
+  return bits[bits.length - 2] + "/" + bits[bits.length - 1];
+}
+
+function search_url(term) {
+  var params = $.param({ term: term, branch: $('#branch').val(), tag: $('#tag').val(), type: $('#type').val() });
+  return "http://localhost:9000/dashboard/"+repository()+"/search?"+params;
+}
+
+function export_url(format) {
+  var params = $.param({ term: $('#search').val(), branch: $('#branch').val(), tag: $('#tag').val(), format: format });
+  return "http://localhost:9000/dashboard/"+repository()+"/commits?"+params;
+}
+
+function sync_url() {
+  return "http://localhost:9000/dashboard/"+repository()+"/sync";
+}
+
+function branches_url() {
+  return "http://localhost:9000/dashboard/"+repository()+"/branches";
 }
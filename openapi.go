@@ -0,0 +1,203 @@
+package search
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIVersion is the version of the API described by the document
+const openAPIVersion = "1.0.0"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPI generates an OpenAPI 3 document describing the API routes
+func openAPI(routes []*apiRoute, server string) map[string]interface{} {
+	schemas := map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"code":    map[string]interface{}{"type": "string"},
+						"message": map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+	errorResponse := map[string]interface{}{
+		"description": "error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		op := map[string]interface{}{
+			"summary":   route.summary,
+			"responses": map[string]interface{}{"default": errorResponse},
+		}
+
+		// Path parameters are read from the route's {name} segments
+		params := []interface{}{}
+		for _, segment := range strings.Split(route.path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				params = append(params, map[string]interface{}{
+					"name":     strings.Trim(segment, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, param := range route.query {
+			params = append(params, map[string]interface{}{
+				"name":        param.name,
+				"in":          "query",
+				"description": param.description,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if route.request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaOf(reflect.TypeOf(route.request), schemas),
+					},
+				},
+			}
+		}
+
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := map[string]interface{}{"description": http.StatusText(status)}
+		if route.response != nil {
+			resp["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": envelopeSchema(route, schemas),
+				},
+			}
+		}
+		op["responses"].(map[string]interface{})[strconv.Itoa(status)] = resp
+
+		item, ok := paths[route.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "git_engine",
+			"version": openAPIVersion,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": server},
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"cookie": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "token"},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"cookie": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+		},
+		"paths": paths,
+	}
+}
+
+// envelopeSchema describes the envelope wrapping the response of a route
+func envelopeSchema(route *apiRoute, schemas map[string]interface{}) map[string]interface{} {
+	data := schemaOf(reflect.TypeOf(route.response), schemas)
+	properties := map[string]interface{}{"data": data}
+	if route.list {
+		properties["data"] = map[string]interface{}{"type": "array", "items": data}
+		properties["meta"] = map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"count": map[string]interface{}{"type": "integer"},
+			},
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// schemaOf describes a Go type through its json tags. Named structs are
+// added to schemas and referenced.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]interface{}{}
+	}
+
+	name := schemaName(t)
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+
+	// Register the name before walking the fields so recursive types end
+	properties := map[string]interface{}{}
+	schemas[name] = map[string]interface{}{"type": "object", "properties": properties}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		properties[tag] = schemaOf(field.Type, schemas)
+	}
+	return ref
+}
+
+// schemaName names the schema of a struct, capitalising unexported types
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if name == "" {
+		return "Object"
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,517 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// schema describes one version of the index templates. Indices are named
+// after the version they were created with and are only ever addressed
+// through their alias, so a new version can be built next to the old one
+// and swapped in atomically.
+type schema struct {
+	Version int
+
+	// Refetch marks versions that add commit fields which cannot be derived
+	// from stored documents, so commits are fetched from Github again
+	// instead of being copied
+	Refetch bool
+
+	// Description summarises the change for operators
+	Description string
+}
+
+// schemas is the registry of schema versions, oldest first. The templates
+// below always describe the last entry.
+var schemas = []*schema{
+	{Version: 1, Description: "typeless indices with a repository keyword field"},
+	{Version: 2, Description: "repository owner, fork and private fields"},
+	{Version: 3, Refetch: true, Description: "repositories keyed by full name"},
+	{Version: 4, Refetch: true, Description: "commits shared between users and identified by sha, workspaces"},
+	{Version: 5, Refetch: true, Description: "branches and tags containing each commit, branches chosen per repository"},
+	{Version: 6, Refetch: true, Description: "pull requests and issue references of each commit"},
+	{Version: 7, Refetch: true, Description: "author and date of each commit"},
+	{Version: 8, Description: "user logins and audit log"},
+	{Version: 9, Description: "user key, client address, search query and status of audit events"},
+	{Version: 10, Description: "owner token of saved searches, checked before alerting"},
+}
+
+// CommitFetcher retrieves the commits of a repository from Github
+type CommitFetcher func(ctx context.Context, repo *Repository) ([]*GitCommit, error)
+
+func currentSchema() *schema {
+	return schemas[len(schemas)-1]
+}
+
+// needsRefetch reports whether moving from version to the current schema
+// crosses a version that cannot be reached by copying documents
+func needsRefetch(version int) bool {
+	for _, s := range schemas {
+		if s.Version > version && s.Refetch {
+			return true
+		}
+	}
+	return false
+}
+
+// Reindex moves the repository list of every user and the shared indices
+// to the current schema version. A new index is built for each alias and
+// filled by copying documents over, then the alias is swapped to the new
+// index in a single atomic action and the old index removed. When the new
+// schema needs fields the stored commits lack, or commits from before they
+// were shared are left, fetch is called for every indexed repository. Only
+// one reindex runs at a time.
+func (s *ElasticStore) Reindex(ctx context.Context, fetch CommitFetcher) error {
+	if !s.reindexing.TryLock() {
+		return ErrReindexRunning
+	}
+	defer s.reindexing.Unlock()
+	if err := s.putTemplates(ctx); err != nil {
+		return err
+	}
+
+	// Migrate the repository lists first, they are needed to refetch
+	// commits
+	users, err := s.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if _, err := s.migrate(ctx, indexPrefix+"-repositories-"+user.Key); err != nil {
+			return err
+		}
+	}
+	for _, alias := range sharedAliases {
+		if err := s.ensureIndex(ctx, alias); err != nil {
+			return err
+		}
+	}
+	for _, alias := range []string{workspacesAlias, branchesAlias, pullsAlias, detailsAlias, searchesAlias, usersAlias, auditAlias} {
+		if _, err := s.migrate(ctx, alias); err != nil {
+			return err
+		}
+	}
+	version, err := s.migrate(ctx, commitsAlias)
+	if err != nil {
+		return err
+	}
+	refetch := needsRefetch(version)
+
+	// Commits indexed per user before they were shared are fetched again
+	for _, user := range users {
+		legacy := indexPrefix + "-commits-" + user.Key
+		if exists, err := s.ES.IndexExists(legacy).Do(ctx); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		indices, err := s.aliasIndices(ctx, legacy)
+		if err != nil {
+			return err
+		}
+		if _, err := s.ES.DeleteIndex(indices...).Do(ctx); err != nil {
+			return err
+		}
+		refetch = true
+	}
+	if !refetch {
+		return nil
+	}
+
+	fullNames, err := s.indexedRepositories(ctx, users)
+	if err != nil {
+		return err
+	}
+	return refetchRepositories(ctx, s.log, fullNames, fetch, func(fullName string, commits []*GitCommit) error {
+		return s.indexCommits(ctx, commitsAlias, fullName, commits)
+	})
+}
+
+// indexedRepositories lists the repositories with indexed commits and those
+// active for any user, whose commits may only have been indexed per user
+func (s *ElasticStore) indexedRepositories(ctx context.Context, users []*UserSummary) ([]string, error) {
+	searchResult, err := s.ES.Search(commitsAlias).
+		Size(0).
+		Aggregation("repositories", elastic.NewTermsAggregation().Field("repository").Size(10000)).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var fullNames []string
+	if buckets, ok := searchResult.Aggregations.Terms("repositories"); ok {
+		for _, bucket := range buckets.Buckets {
+			fullNames = append(fullNames, fmt.Sprint(bucket.Key))
+		}
+	}
+	for _, user := range users {
+		fullNames = append(fullNames, user.Repositories...)
+	}
+	return fullNames, nil
+}
+
+// refetchRepositories fetches the commits of every repository once and
+// hands them to index. Repositories the fetching user cannot read are
+// skipped and logged, they are fetched again at their next sync.
+func refetchRepositories(ctx context.Context, logger *slog.Logger, fullNames []string, fetch CommitFetcher, index func(fullName string, commits []*GitCommit) error) error {
+	seen := make(map[string]bool)
+	for _, fullName := range fullNames {
+		owner, name, ok := splitFullName(fullName)
+		if !ok || seen[fullName] {
+			continue
+		}
+		seen[fullName] = true
+		repo := &Repository{Name: name, FullName: fullName, Owner: &User{Username: owner}}
+		commits, err := fetch(ctx, repo)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnauthorized) {
+			logger.Warn("skipped refetching repository", "repository", fullName, "error", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := index(fullName, commits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate rebuilds the index behind alias by copying its documents, unless
+// it already uses the current schema. The version the alias was on is
+// returned. The old index keeps taking writes while it is copied, and is
+// copied again once the alias is swapped so the documents written in the
+// meantime are replayed. Copies keep the document versions, so a replayed
+// document never overwrites a newer one written to the new index.
+func (s *ElasticStore) migrate(ctx context.Context, alias string) (int, error) {
+	current := currentSchema().Version
+
+	// Find the index behind the alias
+	indices, err := s.aliasIndices(ctx, alias)
+	if err != nil {
+		return 0, err
+	} else if len(indices) != 1 {
+		return 0, fmt.Errorf("alias %s points at %d indices", alias, len(indices))
+	}
+	from := indices[0]
+	version := indexVersion(alias, from)
+	if version >= current {
+		return version, nil
+	}
+
+	// Build the new index next to the old one
+	to := versionedIndex(alias, current)
+	if _, err := s.ES.CreateIndex(to).Do(ctx); err != nil {
+		return 0, err
+	}
+	if err := s.copyDocuments(ctx, from, to); err != nil {
+		s.ES.DeleteIndex(to).Do(ctx)
+		return 0, err
+	}
+
+	// Swap the alias atomically
+	_, err = s.ES.Alias().Action(
+		elastic.NewAliasRemoveAction(alias).Index(from),
+		elastic.NewAliasAddAction(alias).Index(to).IsWriteIndex(true),
+	).Do(ctx)
+	if err != nil {
+		s.ES.DeleteIndex(to).Do(ctx)
+		return 0, err
+	}
+
+	// Replay the writes made during the copy. Documents deleted from the
+	// old index meanwhile are left in the new one.
+	if _, err := s.ES.Refresh(from).Do(ctx); err != nil {
+		return 0, err
+	}
+	if err := s.copyDocuments(ctx, from, to); err != nil {
+		return 0, err
+	}
+	s.log.Info("migrated alias", "alias", alias, "from", from, "to", to)
+
+	_, err = s.ES.DeleteIndex(from).Do(ctx)
+	return version, err
+}
+
+// aliasIndices lists the concrete indices behind an alias
+func (s *ElasticStore) aliasIndices(ctx context.Context, alias string) ([]string, error) {
+	res, err := s.ES.Aliases().Alias(alias).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return res.IndicesByAlias(alias), nil
+}
+
+// copyDocuments copies every document from one index to another with its
+// version. Documents already at that version or newer are skipped.
+func (s *ElasticStore) copyDocuments(ctx context.Context, from, to string) error {
+	resp, err := s.ES.Reindex().
+		SourceIndex(from).
+		Destination(elastic.NewReindexDestination().Index(to).VersionType("external")).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		return err
+	} else if len(resp.Failures) > 0 {
+		return fmt.Errorf("failed to copy %d documents from %s to %s", len(resp.Failures), from, to)
+	}
+	return nil
+}
+
+// indexVersion parses the schema version out of an index name. Indices
+// without a version suffix predate the registry and count as version 0.
+func indexVersion(alias, index string) int {
+	var version int
+	if _, err := fmt.Sscanf(index, alias+"-v%d", &version); err != nil {
+		return 0
+	}
+	return version
+}
+
+// putTemplates installs the versioned index templates. Indices created
+// afterwards pick up the settings and mappings of the matching template.
+func (s *ElasticStore) putTemplates(ctx context.Context) error {
+	for name, body := range indexTemplates() {
+		resp, err := s.ES.IndexPutIndexTemplate(name).BodyJson(body).Do(ctx)
+		if err != nil {
+			return err
+		} else if !resp.Acknowledged {
+			return ErrNotAcknowledged
+		}
+	}
+	return nil
+}
+
+// indexTemplates returns the bodies of the index templates by name
+func indexTemplates() map[string]map[string]interface{} {
+	return map[string]map[string]interface{}{
+		indexPrefix + "-repositories": repositoriesTemplate(),
+		indexPrefix + "-commits":      commitsTemplate(),
+		indexPrefix + "-workspaces":   workspacesTemplate(),
+		indexPrefix + "-branches":     branchesTemplate(),
+		indexPrefix + "-pulls":        pullsTemplate(),
+		indexPrefix + "-details":      detailsTemplate(),
+		indexPrefix + "-searches":     searchesTemplate(),
+		indexPrefix + "-users":        usersTemplate(),
+		indexPrefix + "-audit":        auditTemplate(),
+	}
+}
+
+func repositoriesTemplate() map[string]interface{} {
+	// Build mapping for auto completion
+	properties := map[string]interface{}{
+		"id":        map[string]interface{}{"type": "long"},
+		"name":      map[string]interface{}{"type": "keyword"},
+		"full_name": map[string]interface{}{"type": "keyword"},
+		"fork":      map[string]interface{}{"type": "boolean"},
+		"private":   map[string]interface{}{"type": "boolean"},
+		"active":    map[string]interface{}{"type": "boolean"},
+		"owner": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"login": map[string]interface{}{"type": "keyword"},
+			},
+		},
+		"suggest": map[string]interface{}{
+			"type":            "completion",
+			"analyzer":        "simple",
+			"search_analyzer": "simple",
+		},
+	}
+
+	return indexTemplate(indexPrefix+"-repositories-*", nil, properties)
+}
+
+func commitsTemplate() map[string]interface{} {
+	return indexTemplate(indexPrefix+"-commits-*", ngramSettings(), commitProperties())
+}
+
+// searchesTemplate maps saved searches. The fields of commits are mapped as
+// well, so commits can be percolated through the stored queries.
+func searchesTemplate() map[string]interface{} {
+	properties := commitProperties()
+	for _, field := range []string{"id", "name", "owner", "term", "branch", "tag", "webhook", "email"} {
+		properties[field] = map[string]interface{}{"type": "keyword"}
+	}
+	properties["query"] = map[string]interface{}{"type": "percolator"}
+	properties["token"] = map[string]interface{}{"type": "keyword", "index": false}
+
+	return indexTemplate(indexPrefix+"-searches-*", ngramSettings(), properties)
+}
+
+// commitProperties maps the fields of a commit. Searchable fields are
+// copied into all, which replaces _all.
+func commitProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"repository":   map[string]interface{}{"type": "keyword"},
+		"sha":          map[string]interface{}{"type": "keyword"},
+		"html_url":     map[string]interface{}{"type": "keyword"},
+		"author":       map[string]interface{}{"type": "keyword"},
+		"author_login": map[string]interface{}{"type": "keyword"},
+		"date":         map[string]interface{}{"type": "date"},
+		"branches":     map[string]interface{}{"type": "keyword"},
+		"tags":         map[string]interface{}{"type": "keyword"},
+		"pull_requests": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"number":   map[string]interface{}{"type": "integer"},
+				"title":    ngramText(),
+				"state":    map[string]interface{}{"type": "keyword"},
+				"labels":   map[string]interface{}{"type": "keyword"},
+				"html_url": map[string]interface{}{"type": "keyword"},
+			},
+		},
+		"issues": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"number":   map[string]interface{}{"type": "integer"},
+				"closes":   map[string]interface{}{"type": "boolean"},
+				"html_url": map[string]interface{}{"type": "keyword"},
+			},
+		},
+		"commit_message": ngramText(),
+		"all": map[string]interface{}{
+			"type":            "text",
+			"analyzer":        "ngram_analyzer",
+			"search_analyzer": "standard",
+		},
+	}
+}
+
+func pullsTemplate() map[string]interface{} {
+	// Searchable fields are copied into all, which replaces _all
+	properties := map[string]interface{}{
+		"repository": map[string]interface{}{"type": "keyword"},
+		"type":       map[string]interface{}{"type": "keyword"},
+		"number":     map[string]interface{}{"type": "integer"},
+		"title":      ngramText(),
+		"body":       ngramText(),
+		"state":      map[string]interface{}{"type": "keyword"},
+		"labels":     map[string]interface{}{"type": "keyword"},
+		"author":     map[string]interface{}{"type": "keyword"},
+		"path":       map[string]interface{}{"type": "keyword"},
+		"html_url":   map[string]interface{}{"type": "keyword"},
+		"all": map[string]interface{}{
+			"type":            "text",
+			"analyzer":        "ngram_analyzer",
+			"search_analyzer": "standard",
+		},
+	}
+
+	return indexTemplate(indexPrefix+"-pulls-*", ngramSettings(), properties)
+}
+
+// detailsTemplate maps the details of viewed commits. They are only ever
+// read by id, so diffs are stored without being indexed.
+func detailsTemplate() map[string]interface{} {
+	properties := map[string]interface{}{
+		"repository":     map[string]interface{}{"type": "keyword"},
+		"sha":            map[string]interface{}{"type": "keyword"},
+		"commit_message": map[string]interface{}{"type": "text", "index": false},
+		"date":           map[string]interface{}{"type": "date"},
+		"files":          map[string]interface{}{"type": "object", "enabled": false},
+	}
+
+	return indexTemplate(indexPrefix+"-details-*", nil, properties)
+}
+
+// ngramSettings builds the settings of the n-gram analyzer
+func ngramSettings() map[string]interface{} {
+	return map[string]interface{}{
+		"index.max_ngram_diff": maxGram - minGram,
+		"analysis": map[string]interface{}{
+			"filter": map[string]interface{}{
+				"ngram_filter": map[string]interface{}{
+					"type":     "ngram",
+					"min_gram": minGram,
+					"max_gram": maxGram,
+				},
+			},
+			"analyzer": map[string]interface{}{
+				"ngram_analyzer": map[string]interface{}{
+					"type":      "custom",
+					"tokenizer": "standard",
+					"filter":    []string{"lowercase", "ngram_filter"},
+				},
+			},
+		},
+	}
+}
+
+// ngramText maps a text field searched by n-grams and copied into all
+func ngramText() map[string]interface{} {
+	return map[string]interface{}{
+		"type":            "text",
+		"analyzer":        "ngram_analyzer",
+		"search_analyzer": "standard",
+		"copy_to":         "all",
+	}
+}
+
+func workspacesTemplate() map[string]interface{} {
+	properties := map[string]interface{}{
+		"id":           map[string]interface{}{"type": "keyword"},
+		"name":         map[string]interface{}{"type": "text"},
+		"owner":        map[string]interface{}{"type": "keyword"},
+		"members":      map[string]interface{}{"type": "keyword"},
+		"repositories": map[string]interface{}{"type": "keyword"},
+	}
+
+	return indexTemplate(indexPrefix+"-workspaces-*", nil, properties)
+}
+
+func branchesTemplate() map[string]interface{} {
+	properties := map[string]interface{}{
+		"repository": map[string]interface{}{"type": "keyword"},
+		"branches":   map[string]interface{}{"type": "keyword"},
+	}
+
+	return indexTemplate(indexPrefix+"-branches-*", nil, properties)
+}
+
+func usersTemplate() map[string]interface{} {
+	properties := map[string]interface{}{
+		"key":        map[string]interface{}{"type": "keyword"},
+		"login":      map[string]interface{}{"type": "keyword"},
+		"last_login": map[string]interface{}{"type": "date"},
+	}
+
+	return indexTemplate(indexPrefix+"-users-*", nil, properties)
+}
+
+func auditTemplate() map[string]interface{} {
+	properties := map[string]interface{}{
+		"time":     map[string]interface{}{"type": "date"},
+		"login":    map[string]interface{}{"type": "keyword"},
+		"user_key": map[string]interface{}{"type": "keyword"},
+		"ip":       map[string]interface{}{"type": "ip"},
+		"action":   map[string]interface{}{"type": "keyword"},
+		"target":   map[string]interface{}{"type": "keyword"},
+		"query":    map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+		"outcome":  map[string]interface{}{"type": "keyword"},
+		"status":   map[string]interface{}{"type": "short"},
+	}
+
+	return indexTemplate(indexPrefix+"-audit-*", nil, properties)
+}
+
+// indexTemplate wraps settings and mappings in a composable index template
+// tagged with the current schema version
+func indexTemplate(pattern string, settings, properties map[string]interface{}) map[string]interface{} {
+	template := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"_meta":      map[string]interface{}{"schema_version": currentSchema().Version},
+			"properties": properties,
+		},
+	}
+	if settings != nil {
+		template["settings"] = settings
+	}
+
+	return map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"version":        currentSchema().Version,
+		"_meta":          map[string]interface{}{"schema_version": currentSchema().Version},
+		"template":       template,
+	}
+}
@@ -0,0 +1,685 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned when no index exists for a token
+	ErrUserNotFound = errors.New("no user exists for this token")
+
+	// ErrRepoNotFound is returned when a repository has not been indexed
+	ErrRepoNotFound = errors.New("repository does not exist")
+
+	// ErrRepoTypeMissing is returned when the repository list has not been
+	// created for a token
+	ErrRepoTypeMissing = errors.New("no repository type exists for this token")
+
+	// ErrCommitNotFound is returned when the details of a commit have not
+	// been stored
+	ErrCommitNotFound = errors.New("commit does not exist")
+
+	// ErrSearchNotFound is returned when a saved search does not exist
+	ErrSearchNotFound = errors.New("saved search does not exist")
+
+	// ErrWorkspaceNotFound is returned when a workspace does not exist
+	ErrWorkspaceNotFound = errors.New("workspace does not exist")
+
+	// ErrNotAcknowledged is returned when Elastic Search does not acknowledge
+	// a mapping change
+	ErrNotAcknowledged = errors.New("mapping not acknowledged")
+
+	// ErrReindexRunning is returned when a reindex is started while another
+	// one runs
+	ErrReindexRunning = errors.New("reindex already running")
+)
+
+// Storage persists users, their repository lists, workspaces and the
+// commits of activated repositories. Commits are stored once per repository
+// and shared by every user who can read it.
+type Storage interface {
+	// UserExist checks if a user has already been created
+	UserExist(ctx context.Context, token string) bool
+
+	// CreateUserIndex creates the storage for a new user
+	CreateUserIndex(ctx context.Context, token string) error
+
+	// CreateRepositoryList adds or refreshes a repository in a user's
+	// repository list, keeping its active status
+	CreateRepositoryList(ctx context.Context, token string, r *Repository) error
+
+	// ActivateRepository marks a repository in the list as active
+	ActivateRepository(ctx context.Context, token, fullName string) error
+
+	// DeactivateRepository marks a repository in the list as inactive. Its
+	// commits stay indexed for the other users who activated it.
+	DeactivateRepository(ctx context.Context, token, fullName string) error
+
+	// RepoExists checks if the commits of a repository have been indexed
+	RepoExists(ctx context.Context, fullName string) bool
+
+	// CreateRepository indexes the commits of a repository under its full
+	// name, owner/name, replacing any commits indexed before. The commits
+	// that were not indexed before are returned.
+	CreateRepository(ctx context.Context, fullName string, commits []*GitCommit) ([]*IndexCommit, error)
+
+	// GetCommits searches the commits of a repository
+	GetCommits(ctx context.Context, fullName string, query *SearchQuery) ([]*IndexCommit, error)
+
+	// CountCommits counts the commits of a repository matching a search,
+	// ignoring its page
+	CountCommits(ctx context.Context, fullName string, query *SearchQuery) (int, error)
+
+	// ScrollCommits calls fn for every commit of a repository matching a
+	// search, newest first, until fn returns an error
+	ScrollCommits(ctx context.Context, fullName string, query *SearchQuery, fn func(*IndexCommit) error) error
+
+	// CreatePullRequests indexes the pull requests and review comments of a
+	// repository, replacing any indexed before
+	CreatePullRequests(ctx context.Context, fullName string, pulls []*GitPullRequest, comments []*GitReviewComment) error
+
+	// GetPullRequests searches the pull requests and review comments of a
+	// repository
+	GetPullRequests(ctx context.Context, fullName string, query *SearchQuery) ([]*IndexPullRequest, error)
+
+	// CountPullRequests counts the pull requests and review comments of a
+	// repository matching a search, ignoring its page
+	CountPullRequests(ctx context.Context, fullName string, query *SearchQuery) (int, error)
+
+	// SaveCommitDetail stores the details of a commit, diff included
+	SaveCommitDetail(ctx context.Context, detail *CommitDetail) error
+
+	// GetCommitDetail retrieves the stored details of a commit
+	GetCommitDetail(ctx context.Context, fullName, sha string) (*CommitDetail, error)
+
+	// SetBranches chooses the branches indexed for a repository
+	SetBranches(ctx context.Context, fullName string, branches []string) error
+
+	// GetBranches returns the branches indexed for a repository, none
+	// meaning the default branch
+	GetBranches(ctx context.Context, fullName string) ([]string, error)
+
+	// GetRepositories suggests repositories matching a prefix
+	GetRepositories(ctx context.Context, token, search string) ([]*Repository, error)
+
+	// GetRepository looks up a repository in a user's repository list
+	GetRepository(ctx context.Context, token, fullName string) (*Repository, error)
+
+	// GetActiveRepositories lists the active repositories of a user
+	GetActiveRepositories(ctx context.Context, token string) ([]*Repository, error)
+
+	// CountActiveRepositories counts the active repositories of every user,
+	// a repository active for two users counting twice
+	CountActiveRepositories(ctx context.Context) (int, error)
+
+	// SaveSearch creates or replaces a saved search
+	SaveSearch(ctx context.Context, ss *SavedSearch) error
+
+	// GetSearch retrieves a saved search by id
+	GetSearch(ctx context.Context, id string) (*SavedSearch, error)
+
+	// GetSearches lists the saved searches of a Github user
+	GetSearches(ctx context.Context, login string) ([]*SavedSearch, error)
+
+	// DeleteSearch removes a saved search
+	DeleteSearch(ctx context.Context, id string) error
+
+	// MatchSearches finds the saved searches of a repository matched by
+	// newly indexed commits
+	MatchSearches(ctx context.Context, fullName string, commits []*IndexCommit) ([]*Alert, error)
+
+	// SaveWorkspace creates or replaces a workspace
+	SaveWorkspace(ctx context.Context, ws *Workspace) error
+
+	// GetWorkspace retrieves a workspace by id
+	GetWorkspace(ctx context.Context, id string) (*Workspace, error)
+
+	// AddWorkspaceMember adds a Github user to a workspace without losing
+	// members added concurrently
+	AddWorkspaceMember(ctx context.Context, id, login string) error
+
+	// AddWorkspaceRepository adds a repository to a workspace without
+	// losing repositories added concurrently
+	AddWorkspaceRepository(ctx context.Context, id, fullName string) error
+
+	// GetWorkspaces retrieves the workspaces a Github user is a member of
+	GetWorkspaces(ctx context.Context, login string) ([]*Workspace, error)
+
+	// SaveLogin records the Github login of a user as they sign in
+	SaveLogin(ctx context.Context, token, login string) error
+
+	// GetUsers lists every user and their active repositories
+	GetUsers(ctx context.Context) ([]*UserSummary, error)
+
+	// DeleteUser removes the repository list, login and saved searches of
+	// the user with a key, and their membership of workspaces. Commits are
+	// shared and stay indexed.
+	DeleteUser(ctx context.Context, key string) error
+
+	// GetStats reports the size of the storage and the documents indexed
+	// for every repository
+	GetStats(ctx context.Context) (*StorageStats, error)
+
+	// AppendAudit records an event in the audit log, which is never changed
+	AppendAudit(ctx context.Context, event *AuditEvent) error
+
+	// GetAuditEvents lists the latest events of the audit log matching a
+	// query, newest first
+	GetAuditEvents(ctx context.Context, q *AuditQuery) ([]*AuditEvent, error)
+
+	// Ready checks the storage can serve requests
+	Ready(ctx context.Context) error
+
+	// Close releases the storage once nothing writes to it anymore
+	Close() error
+
+	// Reindex moves the data of every user to the current schema version,
+	// calling fetch for every indexed repository when commits have to be
+	// retrieved from Github again. ErrReindexRunning is returned while
+	// another reindex runs.
+	Reindex(ctx context.Context, fetch CommitFetcher) error
+}
+
+// IndexCommit contains the elements of the document to be indexed
+type IndexCommit struct {
+	Repository  string    `json:"repository"`
+	SHA         string    `json:"sha"`
+	Message     string    `json:"commit_message"`
+	URL         string    `json:"html_url"`
+	Author      string    `json:"author"`
+	AuthorLogin string    `json:"author_login,omitempty"`
+	Date        time.Time `json:"date"`
+	Branches    []string  `json:"branches"`
+	Tags        []string  `json:"tags"`
+
+	PullRequests []*PullRequest `json:"pull_requests"`
+	Issues       []*IssueRef    `json:"issues"`
+}
+
+// PullRequest is the part of a pull request indexed with its commits
+type PullRequest struct {
+	Number int      `json:"number"`
+	Title  string   `json:"title"`
+	State  string   `json:"state"`
+	Labels []string `json:"labels"`
+	URL    string   `json:"html_url"`
+}
+
+// IssueRef is an issue or pull request referenced by a commit message.
+// Closes is set for references like "Fixes #45".
+type IssueRef struct {
+	Number int    `json:"number"`
+	Closes bool   `json:"closes"`
+	URL    string `json:"html_url"`
+}
+
+// searchable returns the text of a commit matched by searches
+func (c *IndexCommit) searchable() string {
+	text := []string{c.Message}
+	for _, pr := range c.PullRequests {
+		text = append(text, pr.Title)
+	}
+	return strings.Join(text, "\n")
+}
+
+// CommitDetail holds everything shown on the page of a commit. Details are
+// stored the first time a commit is viewed, so they stay readable when
+// Github is not.
+type CommitDetail struct {
+	Repository  string        `json:"repository"`
+	SHA         string        `json:"sha"`
+	Message     string        `json:"commit_message"`
+	URL         string        `json:"html_url"`
+	Author      string        `json:"author"`
+	AuthorEmail string        `json:"author_email"`
+	AuthorLogin string        `json:"author_login,omitempty"`
+	Date        time.Time     `json:"date"`
+	Parents     []string      `json:"parents"`
+	Additions   int           `json:"additions"`
+	Deletions   int           `json:"deletions"`
+	Files       []*CommitFile `json:"files"`
+}
+
+// newCommitDetail builds the details of a commit fetched on its own
+func newCommitDetail(fullName string, commit *GitCommit) *CommitDetail {
+	detail := &CommitDetail{
+		Repository: fullName,
+		SHA:        commit.SHA,
+		URL:        commit.HTML,
+		Parents:    []string{},
+		Files:      commit.Files,
+	}
+	if commit.Commit != nil {
+		detail.Message = commit.Commit.Message
+		if author := commit.Commit.Author; author != nil {
+			detail.Author = author.Name
+			detail.AuthorEmail = author.Email
+			detail.Date = author.Date
+		}
+	}
+	if commit.Author != nil {
+		detail.AuthorLogin = commit.Author.Username
+	}
+	for _, parent := range commit.Parents {
+		detail.Parents = append(detail.Parents, parent.SHA)
+	}
+	if commit.Stats != nil {
+		detail.Additions = commit.Stats.Additions
+		detail.Deletions = commit.Stats.Deletions
+	}
+	return detail
+}
+
+// Document types told apart by searches
+const (
+	DocCommit        = "commit"
+	DocPullRequest   = "pull_request"
+	DocReviewComment = "review_comment"
+)
+
+// IndexPullRequest is the document indexed for a pull request or one of its
+// review comments. Review comments carry the number and title of their pull
+// request.
+type IndexPullRequest struct {
+	Repository string   `json:"repository"`
+	Type       string   `json:"type"`
+	Number     int      `json:"number"`
+	Title      string   `json:"title"`
+	Body       string   `json:"body"`
+	State      string   `json:"state,omitempty"`
+	Labels     []string `json:"labels,omitempty"`
+	Author     string   `json:"author"`
+	Path       string   `json:"path,omitempty"`
+	URL        string   `json:"html_url"`
+
+	id string
+}
+
+// searchable returns the text of a pull request matched by searches
+func (p *IndexPullRequest) searchable() string {
+	return p.Title + "\n" + p.Body
+}
+
+// newIndexPullRequests builds the documents indexed for the pull requests
+// of a repository and their review comments
+func newIndexPullRequests(fullName string, pulls []*GitPullRequest, comments []*GitReviewComment) []*IndexPullRequest {
+	var docs []*IndexPullRequest
+	titles := make(map[int]string)
+	for _, pull := range pulls {
+		titles[pull.Number] = pull.Title
+		doc := &IndexPullRequest{
+			Repository: fullName,
+			Type:       DocPullRequest,
+			Number:     pull.Number,
+			Title:      pull.Title,
+			Body:       pull.Body,
+			State:      pull.State,
+			URL:        pull.HTML,
+			id:         fmt.Sprintf("%s#%d", fullName, pull.Number),
+		}
+		if pull.User != nil {
+			doc.Author = pull.User.Username
+		}
+		for _, label := range pull.Labels {
+			doc.Labels = append(doc.Labels, label.Name)
+		}
+		docs = append(docs, doc)
+	}
+	for _, comment := range comments {
+		number := comment.PullRequestNumber()
+		doc := &IndexPullRequest{
+			Repository: fullName,
+			Type:       DocReviewComment,
+			Number:     number,
+			Title:      titles[number],
+			Body:       comment.Body,
+			Path:       comment.Path,
+			URL:        comment.HTML,
+			id:         fmt.Sprintf("%s#%d/%d", fullName, number, comment.ID),
+		}
+		if comment.User != nil {
+			doc.Author = comment.User.Username
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// SearchQuery holds the terms and filters of a search. Empty fields do not
+// filter. Branches and tags only filter commits. From and Size select a
+// page of the results; without a Size the storage's default page is
+// returned.
+type SearchQuery struct {
+	Term   string
+	Branch string
+	Tag    string
+	Type   string
+	From   int
+	Size   int
+}
+
+// unpaged returns a copy of a query without its page
+func (q *SearchQuery) unpaged() *SearchQuery {
+	all := *q
+	all.From, all.Size = 0, 0
+	return &all
+}
+
+// newerCommit orders commits newest first like Elasticsearch sorts equal
+// matches, by SHA when they share a date
+func newerCommit(a, b *IndexCommit) bool {
+	if !a.Date.Equal(b.Date) {
+		return a.Date.After(b.Date)
+	}
+	return a.SHA < b.SHA
+}
+
+// resultPage keeps the results in the page a query asks for, when it asks
+// for one
+func resultPage[T any](items []T, q *SearchQuery) []T {
+	if q.Size <= 0 {
+		return items
+	}
+	start := min(q.From, len(items))
+	return items[start:min(start+q.Size, len(items))]
+}
+
+// Wants checks if a search asks for documents of a type
+func (q *SearchQuery) Wants(docType string) bool {
+	return q.Type == "" || q.Type == docType
+}
+
+// newIndexCommit builds the document indexed for a commit
+func newIndexCommit(fullName string, commit *GitCommit) *IndexCommit {
+	row := &IndexCommit{
+		Repository: fullName,
+		SHA:        commit.SHA,
+		Message:    commit.Commit.Message,
+		URL:        commit.HTML,
+		Branches:   commit.Branches,
+		Tags:       commit.Tags,
+
+		PullRequests: pullRequests(commit.PullRequests),
+		Issues:       parseIssueRefs(commit.issuesURL, commit.Commit.Message),
+	}
+	if author := commit.Commit.Author; author != nil {
+		row.Author = author.Name
+		row.Date = author.Date
+	}
+	if commit.Author != nil {
+		row.AuthorLogin = commit.Author.Username
+	}
+	return row
+}
+
+func pullRequests(pulls []*GitPullRequest) []*PullRequest {
+	var prs []*PullRequest
+	for _, pull := range pulls {
+		pr := &PullRequest{
+			Number: pull.Number,
+			Title:  pull.Title,
+			State:  pull.State,
+			URL:    pull.HTML,
+		}
+		for _, label := range pull.Labels {
+			pr.Labels = append(pr.Labels, label.Name)
+		}
+		prs = append(prs, pr)
+	}
+	return prs
+}
+
+// issueRefPattern matches references like #123 and Fixes #45, optionally
+// preceded by a closing keyword
+var issueRefPattern = regexp.MustCompile(`(?i)(?:\b(close[sd]?|fix(?:e[sd])?|resolve[sd]?):?\s+|^|[^\w/])#(\d+)\b`)
+
+// parseIssueRefs extracts the issues referenced by a commit message,
+// linking them below issuesURL when it is known
+func parseIssueRefs(issuesURL, message string) []*IssueRef {
+	var refs []*IssueRef
+	seen := make(map[int]*IssueRef)
+	for _, m := range issueRefPattern.FindAllStringSubmatch(message, -1) {
+		number, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		closes := m[1] != ""
+		if ref, ok := seen[number]; ok {
+			ref.Closes = ref.Closes || closes
+			continue
+		}
+		ref := &IssueRef{Number: number, Closes: closes}
+		if issuesURL != "" {
+			ref.URL = fmt.Sprintf("%s/%d", issuesURL, number)
+		}
+		seen[number] = ref
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// Matches checks if a commit passes the branch and tag filters
+func (q *SearchQuery) Matches(commit *IndexCommit) bool {
+	if q.Branch != "" && !contains(commit.Branches, q.Branch) {
+		return false
+	}
+	if q.Tag != "" && !contains(commit.Tags, q.Tag) {
+		return false
+	}
+	return true
+}
+
+// SavedSearch is a named commit search of a repository. New commits it
+// matches are delivered to its webhook, its email address or both.
+type SavedSearch struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	Repository string `json:"repository"`
+	Term       string `json:"term"`
+	Branch     string `json:"branch,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Webhook    string `json:"webhook,omitempty"`
+	Email      string `json:"email,omitempty"`
+
+	// token is the Github token of the owner, stored with the search so
+	// their access is checked before alerting. It is never sent.
+	token string
+}
+
+// storedSearch is the stored document of a saved search, holding the
+// owner's token next to the fields sent to users
+type storedSearch struct {
+	*SavedSearch
+	Token string `json:"token,omitempty"`
+}
+
+// newStoredSearch wraps a saved search for storing
+func newStoredSearch(ss *SavedSearch) *storedSearch {
+	return &storedSearch{SavedSearch: ss, Token: ss.token}
+}
+
+// decodeSearch reads a stored saved search back with its owner's token
+func decodeSearch(data []byte) (*SavedSearch, error) {
+	stored := &storedSearch{SavedSearch: &SavedSearch{}}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, err
+	}
+	stored.SavedSearch.token = stored.Token
+	return stored.SavedSearch, nil
+}
+
+// Query returns the search run by a saved search
+func (ss *SavedSearch) Query() *SearchQuery {
+	return &SearchQuery{
+		Term:   ss.Term,
+		Branch: ss.Branch,
+		Tag:    ss.Tag,
+		Type:   DocCommit,
+	}
+}
+
+// Alert holds the new commits matched by a saved search
+type Alert struct {
+	Search  *SavedSearch   `json:"search"`
+	Commits []*IndexCommit `json:"commits"`
+}
+
+// Workspace shares a set of indexed repositories between its members, who
+// are identified by their Github login
+type Workspace struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Owner        string   `json:"owner"`
+	Members      []string `json:"members"`
+	Repositories []string `json:"repositories"`
+}
+
+// HasMember checks if a Github user is a member of the workspace
+func (ws *Workspace) HasMember(login string) bool {
+	return contains(ws.Members, login)
+}
+
+// HasRepository checks if a repository belongs to the workspace
+func (ws *Workspace) HasRepository(fullName string) bool {
+	return contains(ws.Repositories, fullName)
+}
+
+// addMember adds a member unless they already are one, and reports whether
+// the workspace changed
+func (ws *Workspace) addMember(login string) bool {
+	if ws.HasMember(login) {
+		return false
+	}
+	ws.Members = append(ws.Members, login)
+	return true
+}
+
+// addRepository adds a repository unless it is already shared, and reports
+// whether the workspace changed
+func (ws *Workspace) addRepository(fullName string) bool {
+	if ws.HasRepository(fullName) {
+		return false
+	}
+	ws.Repositories = append(ws.Repositories, fullName)
+	return true
+}
+
+// UserSummary describes a user to admins. Users are told apart by the key
+// derived from their token, tokens are never shown. Users who have not
+// signed in since logins were recorded have no login.
+type UserSummary struct {
+	Key          string     `json:"key"`
+	Login        string     `json:"login,omitempty"`
+	LastLogin    *time.Time `json:"last_login,omitempty"`
+	Repositories []string   `json:"active_repositories"`
+}
+
+// userRecord is the stored login of a user
+type userRecord struct {
+	Key       string    `json:"key"`
+	Login     string    `json:"login"`
+	LastLogin time.Time `json:"last_login"`
+}
+
+// StorageStats holds the size of the storage and what it indexes per
+// repository
+type StorageStats struct {
+	Indices      []*IndexStats      `json:"indices"`
+	Repositories []*RepositoryStats `json:"repositories"`
+}
+
+// IndexStats describes an Elasticsearch index, or the whole file or memory
+// of other stores
+type IndexStats struct {
+	Name      string `json:"name"`
+	Documents int64  `json:"documents"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// RepositoryStats counts the documents indexed for a repository
+type RepositoryStats struct {
+	Repository   string `json:"repository"`
+	Commits      int64  `json:"commits"`
+	PullRequests int64  `json:"pull_requests"`
+}
+
+// repositoryStats sorts the counts of repositories by name
+func repositoryStats(byName map[string]*RepositoryStats) []*RepositoryStats {
+	stats := make([]*RepositoryStats, 0, len(byName))
+	for _, s := range byName {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Repository < stats[j].Repository })
+	return stats
+}
+
+// AuditEvent records an action taken by a user or an admin. Users are
+// named by their login, and by the key derived from their token when the
+// login is unknown.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Login   string    `json:"login,omitempty"`
+	UserKey string    `json:"user_key,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target,omitempty"`
+	Query   string    `json:"query,omitempty"`
+	Outcome string    `json:"outcome"`
+	Status  int       `json:"status"`
+}
+
+// AuditQuery filters the audit log. Empty fields match every event.
+type AuditQuery struct {
+	Login  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// Matches reports whether an event passes the filters of a query
+func (q *AuditQuery) Matches(e *AuditEvent) bool {
+	switch {
+	case q.Login != "" && e.Login != q.Login:
+		return false
+	case q.Action != "" && e.Action != q.Action:
+		return false
+	case q.Target != "" && e.Target != q.Target:
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// without returns values without value
+func without(values []string, value string) []string {
+	kept := []string{}
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
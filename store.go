@@ -1,177 +1,362 @@
 package search
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"gopkg.in/olivere/elastic.v3"
+	"github.com/olivere/elastic/v7"
 )
 
-// Store holds the Elastic Search client
-type Store struct {
+const (
+	// indexPrefix namespaces every index, alias and template
+	indexPrefix = "git_engine"
+
+	// commitsAlias is the alias of the commits of every indexed repository
+	commitsAlias = indexPrefix + "-commits"
+
+	// workspacesAlias is the alias of the workspaces
+	workspacesAlias = indexPrefix + "-workspaces"
+
+	// branchesAlias is the alias of the branches chosen per repository
+	branchesAlias = indexPrefix + "-branches"
+
+	// pullsAlias is the alias of pull requests and review comments
+	pullsAlias = indexPrefix + "-pulls"
+
+	// detailsAlias is the alias of the details of viewed commits
+	detailsAlias = indexPrefix + "-details"
+
+	// searchesAlias is the alias of saved searches, stored as percolator
+	// queries
+	searchesAlias = indexPrefix + "-searches"
+
+	// usersAlias is the alias of the logins of users, keyed by user key
+	usersAlias = indexPrefix + "-users"
+
+	// auditAlias is the alias of the audit log
+	auditAlias = indexPrefix + "-audit"
+
+	// scrollSize is the number of documents fetched per scroll page
+	scrollSize = 500
+
+	// connectTimeout bounds the time spent waiting for Elasticsearch at
+	// startup, and maxBackoff the wait between two attempts
+	connectTimeout = 2 * time.Minute
+	maxBackoff     = 30 * time.Second
+)
+
+// ElasticStore implements Storage on top of Elastic Search. Every user has a
+// repository list of their own. Commits are indexed once per repository in
+// a shared typeless index and told apart by their repository field. Every
+// index is reached through an alias.
+type ElasticStore struct {
 	ES *elastic.Client
+
+	log        *slog.Logger
+	reindexing sync.Mutex
 }
 
-// NewStore returns a new instance of store
-func NewStore() *Store {
-	return &Store{
-		ES: MustOpenConnection(),
+// NewElasticStore returns a new instance of ElasticStore logging to logger,
+// installs the index templates and creates the shared indices. While
+// Elasticsearch is unreachable it retries with exponential backoff, up to
+// connectTimeout or until ctx is done.
+func NewElasticStore(ctx context.Context, logger *slog.Logger) (*ElasticStore, error) {
+	deadline := time.Now().Add(connectTimeout)
+	backoff := time.Second
+	for {
+		s, err := connectElastic(ctx, logger)
+		if err == nil {
+			return s, nil
+		} else if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		logger.Warn("elasticsearch unavailable, retrying", "in", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 	}
 }
 
-// MustOpenConnection will create a client for Elastic Search
-func MustOpenConnection() *elastic.Client {
-	c, err := elastic.NewClient()
+// connectElastic makes one attempt at connecting to Elasticsearch and
+// setting up the indices
+func connectElastic(ctx context.Context, logger *slog.Logger) (*ElasticStore, error) {
+	c, err := elastic.NewClient(
+		elastic.SetHttpClient(&http.Client{
+			Transport: &elasticTransport{next: http.DefaultTransport},
+		}),
+	)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	s := &ElasticStore{
+		ES:  c,
+		log: logger,
+	}
+	if err := s.putTemplates(ctx); err != nil {
+		return nil, err
+	}
+	for _, alias := range sharedAliases {
+		if err := s.ensureIndex(ctx, alias); err != nil {
+			return nil, err
+		}
 	}
-	return c
+	return s, nil
 }
 
 // UserExist checks if a user has already been created
-func (s *Store) UserExist(token string) bool {
-	exists, err := s.ES.IndexExists(token).Do()
+func (s *ElasticStore) UserExist(ctx context.Context, token string) bool {
+	exists, err := s.ES.IndexExists(repositoriesAlias(token)).Do(ctx)
 	if err != nil || !exists {
 		return false
 	}
 	return true
 }
 
-// RepoExists checks if a repo has already been created
-func (s *Store) RepoExists(token, name string) bool {
-	exists, err := s.ES.TypeExists().Index(token).Type(name).Do()
-	if err != nil || !exists {
+// RepoExists checks if the commits of a repository have been indexed
+func (s *ElasticStore) RepoExists(ctx context.Context, fullName string) bool {
+	count, err := s.ES.Count(commitsAlias).
+		Query(elastic.NewTermQuery("repository", fullName)).
+		Do(ctx)
+	if err != nil || count == 0 {
 		return false
 	}
 	return true
 }
 
-// CreateUserIndex creates a new index
-func (s *Store) CreateUserIndex(token string) error {
+// CreateUserIndex creates the repository list of a user. Settings and
+// mappings come from the index templates.
+func (s *ElasticStore) CreateUserIndex(ctx context.Context, token string) error {
+	return s.createIndex(ctx, repositoriesAlias(token), currentSchema().Version)
+}
 
-	j := indexSettingsAndMapping()
+// ensureIndex creates the index behind a shared alias if it is missing
+func (s *ElasticStore) ensureIndex(ctx context.Context, alias string) error {
+	exists, err := s.ES.IndexExists(alias).Do(ctx)
+	if err != nil || exists {
+		return err
+	}
+	return s.createIndex(ctx, alias, currentSchema().Version)
+}
 
-	if _, err := s.ES.CreateIndex(token).BodyJson(j).Do(); err != nil {
+func (s *ElasticStore) createIndex(ctx context.Context, alias string, version int) error {
+	body := map[string]interface{}{
+		"aliases": map[string]interface{}{
+			alias: map[string]interface{}{
+				"is_write_index": true,
+			},
+		},
+	}
+	if _, err := s.ES.CreateIndex(versionedIndex(alias, version)).BodyJson(body).Do(ctx); err != nil {
 		return err
 	}
 	return nil
 }
 
-// RepoSuggest serves as a json encoder for elastic search suggestions
+// RepoSuggest serves as a json encoder for elastic search suggestions. The
+// suggester returns the whole document, so owner, fork, private and active
+// status come back with every suggestion.
 type RepoSuggest struct {
-	Name    string   `json:"name"`
-	Active  bool     `json:"active"`
-	ID      int      `json:"id"`
-	Suggest *suggest `json:"suggest"`
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	FullName string   `json:"full_name"`
+	Owner    *User    `json:"owner,omitempty"`
+	Fork     bool     `json:"fork"`
+	Private  bool     `json:"private"`
+	Active   bool     `json:"active"`
+	Suggest  *suggest `json:"suggest"`
 }
 
 type suggest struct {
-	Input   []string `json:"input"`
-	Output  string   `json:"output"`
-	Payload *payload `json:"payload"`
-}
-
-type payload struct {
-	ID int `json:"id"`
+	Input []string `json:"input"`
 }
 
-// CreateRepositoryList creates a new repository type
-func (s *Store) CreateRepositoryList(token string, r *Repository) error {
-	if !s.UserExist(token) {
-		return errors.New("no user exists for this token")
-	}
-
-	exist, err := s.ES.TypeExists().Index(token).Type("repository").Do()
-	if !exist {
-		if err := s.createAutoCompleteMapping(token); err != nil {
-			return err
-		}
+// CreateRepositoryList adds a repository to the repository list. Refreshing
+// a repository that is already listed keeps its active status.
+func (s *ElasticStore) CreateRepositoryList(ctx context.Context, token string, r *Repository) error {
+	if !s.UserExist(ctx, token) {
+		return ErrUserNotFound
 	}
 
 	// Create repository suggestion
 	rs := &RepoSuggest{
-		ID:     r.ID,
-		Name:   r.Name,
-		Active: r.Active,
+		ID:       r.ID,
+		Name:     r.Name,
+		FullName: r.FullName,
+		Owner:    r.Owner,
+		Fork:     r.Fork,
+		Private:  r.Private,
+		Active:   r.Active,
 		Suggest: &suggest{
-			Input:  []string{r.Name},
-			Output: r.Name,
-			Payload: &payload{
-				ID: r.ID,
-			},
+			Input: []string{r.Name, r.FullName},
 		},
 	}
+	fields := map[string]interface{}{
+		"name":      rs.Name,
+		"full_name": rs.FullName,
+		"owner":     rs.Owner,
+		"fork":      rs.Fork,
+		"private":   rs.Private,
+		"suggest":   rs.Suggest,
+	}
 
 	// Index repository
-	doc, err := s.ES.Index().
+	_, err := s.ES.Update().
+		Index(repositoriesAlias(token)).
 		Id(strconv.Itoa(r.ID)).
-		Index(token).
-		Type("repository").
-		BodyJson(rs).
-		Do()
+		Doc(fields).
+		Upsert(rs).
+		Do(ctx)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Indexed repository %s to index %s, type %s\n", doc.Id, doc.Index, doc.Type)
+	s.log.Debug("indexed repository", "repository", r.FullName, "user", userKey(token))
 	return nil
 }
 
-// CreateRepository creates a repository for commits
-func (s *Store) CreateRepository(name, owner, token string, commits []*GitCommit) error {
-	if !s.UserExist(token) {
-		return errors.New("no user exists for this token")
+// sharedAliases are the aliases of indices shared by every user
+var sharedAliases = []string{commitsAlias, workspacesAlias, branchesAlias, pullsAlias, detailsAlias, searchesAlias, usersAlias, auditAlias}
+
+// CreateRepository indexes the commits of a repository under its full name.
+// Commits are indexed in place, and those indexed before which are no longer
+// fetched, such as commits of branches no longer chosen, are removed once
+// the new ones are all indexed. A failed index leaves the commits indexed
+// before searchable.
+func (s *ElasticStore) CreateRepository(ctx context.Context, fullName string, commits []*GitCommit) ([]*IndexCommit, error) {
+	known, err := s.documentIDs(ctx, commitsAlias, fullName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.indexCommits(ctx, commitsAlias, fullName, commits); err != nil {
+		return nil, err
 	}
 
-	// Index commits
+	var added []*IndexCommit
 	for _, commit := range commits {
-		row := &IndexCommit{
-			Message: commit.Commit.Message,
-			URL:     commit.HTML,
-		}
-		doc, err := s.ES.Index().
-			Index(token).
-			Type(name).
-			BodyJson(row).
-			Do()
-		if err != nil {
-			return err
+		id := commitID(fullName, commit.SHA)
+		if !known[id] {
+			added = append(added, newIndexCommit(fullName, commit))
 		}
-		fmt.Printf("Indexed commit %s to index %s, repository %s\n", doc.Id, doc.Index, doc.Type)
+		delete(known, id)
+	}
+	if err := s.deleteDocuments(ctx, commitsAlias, known); err != nil {
+		return nil, err
 	}
+	return added, nil
+}
 
-	return nil
+// documentIDs lists the ids of the documents of a repository in an index
+func (s *ElasticStore) documentIDs(ctx context.Context, alias, fullName string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	scroll := s.ES.Scroll(alias).
+		Query(elastic.NewTermQuery("repository", fullName)).
+		FetchSource(false).
+		Size(scrollSize).
+		KeepAlive("1m")
+	defer scroll.Clear(context.WithoutCancel(ctx))
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return ids, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			ids[hit.Id] = true
+		}
+	}
 }
 
-// ActivateRepository activates a repository
-func (s *Store) ActivateRepository(token, repoName string) error {
-	// Search for matching repository
-	query := elastic.NewMatchQuery("name", repoName)
-	searchResult, err := s.ES.Search(token).
-		Index(token).
-		Type("repository").
-		Query(query).
-		Do()
+// deleteDocuments removes documents from an index by id
+func (s *ElasticStore) deleteDocuments(ctx context.Context, alias string, ids map[string]bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	bulk := s.ES.Bulk().Refresh("wait_for")
+	for id := range ids {
+		bulk.Add(elastic.NewBulkDeleteRequest().
+			Index(alias).
+			Id(id))
+	}
+	resp, err := bulk.Do(ctx)
 	if err != nil {
 		return err
+	} else if failed := resp.Failed(); len(failed) > 0 {
+		return fmt.Errorf("failed to delete %d documents: %s", len(failed), failed[0].Error.Reason)
 	}
+	return nil
+}
 
-	if searchResult.Hits == nil {
-		return errors.New("repository does not exist")
+func (s *ElasticStore) indexCommits(ctx context.Context, index, fullName string, commits []*GitCommit) error {
+	if len(commits) == 0 {
+		return nil
 	}
-	var repo Repository
-	if err := json.Unmarshal(*searchResult.Hits.Hits[0].Source, &repo); err != nil {
+
+	// Index commits
+	bulk := s.ES.Bulk().Refresh("wait_for")
+	for _, commit := range commits {
+		bulk.Add(elastic.NewBulkIndexRequest().
+			Index(index).
+			Id(commitID(fullName, commit.SHA)).
+			Doc(newIndexCommit(fullName, commit)))
+	}
+	resp, err := bulk.Do(ctx)
+	if err != nil {
 		return err
+	} else if failed := resp.Failed(); len(failed) > 0 {
+		return fmt.Errorf("failed to index %d commits: %s", len(failed), failed[0].Error.Reason)
+	}
+	commitsIndexed.WithLabelValues(fullName).Add(float64(len(commits)))
+	s.log.Info("indexed commits", "repository", fullName, "index", index, "count", len(commits))
+
+	return nil
+}
+
+// ActivateRepository activates a repository by its full name
+func (s *ElasticStore) ActivateRepository(ctx context.Context, token, fullName string) error {
+	return s.setActive(ctx, token, fullName, true)
+}
+
+// DeactivateRepository deactivates a repository by its full name
+func (s *ElasticStore) DeactivateRepository(ctx context.Context, token, fullName string) error {
+	return s.setActive(ctx, token, fullName, false)
+}
+
+// setActive sets the active status of a repository in the repository list
+func (s *ElasticStore) setActive(ctx context.Context, token, fullName string, active bool) error {
+	// Search for matching repository
+	searchResult, err := s.ES.Search(repositoriesAlias(token)).
+		Query(elastic.NewTermQuery("full_name", fullName)).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	if searchResult.Hits == nil || len(searchResult.Hits.Hits) == 0 {
+		return ErrRepoNotFound
 	}
 
-	script := elastic.NewScript("ctx._source.active = true")
 	_, err = s.ES.Update().
-		Index(token).
-		Type("repository").
-		Id(strconv.Itoa(repo.ID)).
-		Script(script).
-		Do()
+		Index(repositoriesAlias(token)).
+		Id(searchResult.Hits.Hits[0].Id).
+		Doc(map[string]interface{}{"active": active}).
+		Refresh("wait_for").
+		Do(ctx)
 	if err != nil {
 		return err
 	}
@@ -179,21 +364,22 @@ func (s *Store) ActivateRepository(token, repoName string) error {
 	return nil
 }
 
-// GetCommits returns commits for a given repository
-func (s *Store) GetCommits(token, repoName, substring string) ([]*IndexCommit, error) {
-	if !s.UserExist(token) {
-		return nil, errors.New("no user exists for this token")
-	} else if !s.RepoExists(token, repoName) {
-		return nil, errors.New("no repository named " + repoName + " type exists for this token")
+// GetCommits returns commits for a given repository full name, best
+// matches first then newest first. Without a term every commit passing the
+// filters matches.
+func (s *ElasticStore) GetCommits(ctx context.Context, fullName string, q *SearchQuery) ([]*IndexCommit, error) {
+	if !s.RepoExists(ctx, fullName) {
+		return nil, ErrRepoNotFound
 	}
 
 	// Search for matching commits
-	query := elastic.NewMatchQuery("_all", substring)
-	searchResult, err := s.ES.Search(token).
-		Index(token).
-		Type(repoName).
-		Query(query).
-		Do()
+	search := s.ES.Search(commitsAlias).
+		Query(commitsQuery(fullName, q)).
+		SortBy(elastic.NewScoreSort(), elastic.NewFieldSort("date").Desc())
+	if q.Size > 0 {
+		search = search.From(q.From).Size(q.Size)
+	}
+	searchResult, err := search.Do(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -202,7 +388,7 @@ func (s *Store) GetCommits(token, repoName, substring string) ([]*IndexCommit, e
 	var commits []*IndexCommit
 	for _, hit := range searchResult.Hits.Hits {
 		var commit IndexCommit
-		if err := json.Unmarshal(*hit.Source, &commit); err != nil {
+		if err := json.Unmarshal(hit.Source, &commit); err != nil {
 			return nil, err
 		}
 		commits = append(commits, &commit)
@@ -211,86 +397,250 @@ func (s *Store) GetCommits(token, repoName, substring string) ([]*IndexCommit, e
 	return commits, nil
 }
 
-// IndexCommit contains the elements of the document to be indexed
-type IndexCommit struct {
-	Message string `json:"commit_message"`
-	URL     string `json:"html_url"`
+// CountCommits counts the matching commits of a repository
+func (s *ElasticStore) CountCommits(ctx context.Context, fullName string, q *SearchQuery) (int, error) {
+	if !s.RepoExists(ctx, fullName) {
+		return 0, ErrRepoNotFound
+	}
+	count, err := s.ES.Count(commitsAlias).
+		Query(commitsQuery(fullName, q)).
+		Do(ctx)
+	return int(count), err
 }
 
-// Search contains search terms for a ES query
-type Search struct {
-	Query *match `json:"match"`
+// ScrollCommits pages through every matching commit with a scroll, newest
+// first
+func (s *ElasticStore) ScrollCommits(ctx context.Context, fullName string, q *SearchQuery, fn func(*IndexCommit) error) error {
+	if !s.RepoExists(ctx, fullName) {
+		return ErrRepoNotFound
+	}
+
+	scroll := s.ES.Scroll(commitsAlias).
+		Query(commitsQuery(fullName, q)).
+		Sort("date", false).
+		Size(scrollSize).
+		KeepAlive("1m")
+	// Free the scroll even when ctx ended it
+	defer scroll.Clear(context.WithoutCancel(ctx))
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var commit IndexCommit
+			if err := json.Unmarshal(hit.Source, &commit); err != nil {
+				return err
+			}
+			if err := fn(&commit); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// commitsQuery builds the query of a commit search. Without a term every
+// commit passing the filters matches.
+func commitsQuery(fullName string, q *SearchQuery) elastic.Query {
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("repository", fullName))
+	if q.Term != "" {
+		query = query.Must(elastic.NewMatchQuery("all", q.Term))
+	}
+	if q.Branch != "" {
+		query = query.Filter(elastic.NewTermQuery("branches", q.Branch))
+	}
+	if q.Tag != "" {
+		query = query.Filter(elastic.NewTermQuery("tags", q.Tag))
+	}
+	return query
 }
 
-type match struct {
-	All string `json:"_all"`
+// CreatePullRequests indexes the pull requests and review comments of a
+// repository in place, removing those indexed before which are gone
+func (s *ElasticStore) CreatePullRequests(ctx context.Context, fullName string, pulls []*GitPullRequest, comments []*GitReviewComment) error {
+	stale, err := s.documentIDs(ctx, pullsAlias, fullName)
+	if err != nil {
+		return err
+	}
+
+	docs := newIndexPullRequests(fullName, pulls, comments)
+	if len(docs) > 0 {
+		bulk := s.ES.Bulk().Refresh("wait_for")
+		for _, doc := range docs {
+			bulk.Add(elastic.NewBulkIndexRequest().
+				Index(pullsAlias).
+				Id(doc.id).
+				Doc(doc))
+			delete(stale, doc.id)
+		}
+		resp, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		} else if failed := resp.Failed(); len(failed) > 0 {
+			return fmt.Errorf("failed to index %d pull requests: %s", len(failed), failed[0].Error.Reason)
+		}
+		s.log.Info("indexed pull requests", "repository", fullName, "index", pullsAlias, "count", len(docs))
+	}
+
+	// Remove those indexed before only once the new ones are
+	return s.deleteDocuments(ctx, pullsAlias, stale)
 }
 
-// GetRepositories retrieves a repository from the index
-func (s *Store) GetRepositories(token, search string) ([]*Repository, error) {
-	if !s.UserExist(token) {
-		return nil, errors.New("no user exists for this token")
-	} else if !s.RepoExists(token, "repository") {
-		return nil, errors.New("no repository type exists for this token")
+// GetPullRequests searches the pull requests and review comments of a
+// repository
+func (s *ElasticStore) GetPullRequests(ctx context.Context, fullName string, q *SearchQuery) ([]*IndexPullRequest, error) {
+	search := s.ES.Search(pullsAlias).
+		Query(pullsQuery(fullName, q))
+	if q.Size > 0 {
+		search = search.From(q.From).Size(q.Size)
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pulls []*IndexPullRequest
+	for _, hit := range searchResult.Hits.Hits {
+		var pull IndexPullRequest
+		if err := json.Unmarshal(hit.Source, &pull); err != nil {
+			return nil, err
+		}
+		pulls = append(pulls, &pull)
+	}
+	return pulls, nil
+}
+
+// CountPullRequests counts the matching pull requests and review comments
+func (s *ElasticStore) CountPullRequests(ctx context.Context, fullName string, q *SearchQuery) (int, error) {
+	count, err := s.ES.Count(pullsAlias).
+		Query(pullsQuery(fullName, q)).
+		Do(ctx)
+	return int(count), err
+}
+
+// pullsQuery builds the query of a pull request and review comment search
+func pullsQuery(fullName string, q *SearchQuery) elastic.Query {
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("repository", fullName))
+	if q.Term != "" {
+		query = query.Must(elastic.NewMatchQuery("all", q.Term))
+	}
+	if q.Type != "" {
+		query = query.Filter(elastic.NewTermQuery("type", q.Type))
+	}
+	return query
+}
+
+// GetRepositories suggests repositories starting with search in a single
+// completion query, active repositories included
+func (s *ElasticStore) GetRepositories(ctx context.Context, token, search string) ([]*Repository, error) {
+	if !s.UserExist(ctx, token) {
+		return nil, ErrUserNotFound
 	}
 
 	comp := elastic.NewCompletionSuggester("repository-suggest").
 		Field("suggest").
-		Text(search)
+		Text(search).
+		Size(suggestSize).
+		SkipDuplicates(true)
 
-	searchResult, err := s.ES.Suggest(token).Suggester(comp).Do()
+	searchResult, err := s.ES.Search(repositoriesAlias(token)).
+		Suggester(comp).
+		Do(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	sug := searchResult["repository-suggest"][0].Options
-
 	var repos []*Repository
-	for _, value := range sug {
-		active := value.Payload.(map[string]interface{})["id"].(float64)
-		on, err := s.isActivated(token, int(active))
-		if err != nil {
-			return nil, err
-		}
-		if !on {
-			repos = append(repos, &Repository{Name: value.Text})
+	for _, sug := range searchResult.Suggest["repository-suggest"] {
+		for _, option := range sug.Options {
+			var repo Repository
+			if err := json.Unmarshal(option.Source, &repo); err != nil {
+				return nil, err
+			}
+			repos = append(repos, &repo)
 		}
 	}
 
 	return repos, nil
 }
 
-func (s *Store) isActivated(token string, id int) (bool, error) {
-	doc, err := s.ES.Get().
-		Index(token).
-		Type("repository").
-		Id(strconv.Itoa(id)).
-		Fields("active").
-		Do()
+// GetRepository looks up a repository in the repository list
+func (s *ElasticStore) GetRepository(ctx context.Context, token, fullName string) (*Repository, error) {
+	if !s.UserExist(ctx, token) {
+		return nil, ErrUserNotFound
+	}
+
+	searchResult, err := s.ES.Search(repositoriesAlias(token)).
+		Query(elastic.NewTermQuery("full_name", fullName)).
+		Do(ctx)
 	if err != nil {
-		return false, err
-	} else if !doc.Found {
-		return false, errors.New("no document found")
+		return nil, err
+	} else if searchResult.Hits == nil || len(searchResult.Hits.Hits) == 0 {
+		return nil, ErrRepoNotFound
 	}
 
-	return doc.Fields["active"].([]interface{})[0].(bool), nil
+	var repo Repository
+	if err := json.Unmarshal(searchResult.Hits.Hits[0].Source, &repo); err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// Close stops the Elasticsearch client. Bulk requests are sent
+// synchronously, so nothing is left buffered once writers are done.
+func (s *ElasticStore) Close() error {
+	s.ES.Stop()
+	return nil
+}
+
+// Ready checks the cluster is not red and every index template is installed
+func (s *ElasticStore) Ready(ctx context.Context) error {
+	health, err := s.ES.ClusterHealth().Do(ctx)
+	if err != nil {
+		return err
+	} else if health.Status == "red" {
+		return fmt.Errorf("elasticsearch cluster %s is red", health.ClusterName)
+	}
+
+	resp, err := s.ES.IndexGetIndexTemplate(indexPrefix + "-*").Do(ctx)
+	if err != nil {
+		return err
+	}
+	installed := map[string]bool{}
+	for _, t := range resp.IndexTemplates {
+		installed[t.Name] = true
+	}
+	for name := range indexTemplates() {
+		if !installed[name] {
+			return fmt.Errorf("index template %s is missing", name)
+		}
+	}
+	return nil
+}
+
+// CountActiveRepositories counts the active repositories of every user
+func (s *ElasticStore) CountActiveRepositories(ctx context.Context) (int, error) {
+	count, err := s.ES.Count(indexPrefix + "-repositories-*").
+		Query(elastic.NewTermQuery("active", true)).
+		Do(ctx)
+	return int(count), err
 }
 
 // GetActiveRepositories retrieves active repositories from ES
-func (s *Store) GetActiveRepositories(token string) ([]*Repository, error) {
-	if !s.UserExist(token) {
-		return nil, errors.New("no user exists for this token")
-	} else if !s.RepoExists(token, "repository") {
-		return nil, errors.New("no repository type exists for this token")
+func (s *ElasticStore) GetActiveRepositories(ctx context.Context, token string) ([]*Repository, error) {
+	if !s.UserExist(ctx, token) {
+		return nil, ErrUserNotFound
 	}
 
 	// Search for matching repository
-	query := elastic.NewMatchQuery("active", true)
-	searchResult, err := s.ES.Search(token).
-		Index(token).
-		Type("repository").
-		Query(query).
-		Do()
+	searchResult, err := s.ES.Search(repositoriesAlias(token)).
+		Query(elastic.NewTermQuery("active", true)).
+		Size(1000).
+		Do(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -299,94 +649,601 @@ func (s *Store) GetActiveRepositories(token string) ([]*Repository, error) {
 		var repos []*Repository
 		for _, hit := range searchResult.Hits.Hits {
 			var repo Repository
-			if err := json.Unmarshal(*hit.Source, &repo); err != nil {
+			if err := json.Unmarshal(hit.Source, &repo); err != nil {
 				return nil, err
 			}
 			repos = append(repos, &repo)
 		}
 		return repos, nil
 	}
-	return nil, errors.New("repository does not exist")
-}
-
-func (s *Store) createAutoCompleteMapping(token string) error {
-	// Build mapping for auto completion
-	j := make(map[string]interface{})
-	properties := make(map[string]interface{})
-	name := make(map[string]string)
-	suggest := make(map[string]string)
-	name["type"] = "string"
-	suggest["type"] = "completion"
-	suggest["analyzer"] = "simple"
-	suggest["search_analyzer"] = "simple"
-	suggest["payloads"] = "true"
-	properties["name"] = name
-	properties["suggest"] = suggest
-	j["properties"] = properties
-
-	// Set mapping for autocompletion
-	mapping, err := s.ES.PutMapping().
-		Index(token).
-		Type("repository").
-		BodyJson(j).
-		Do()
+	return nil, ErrRepoNotFound
+}
+
+// SaveCommitDetail stores the details of a commit
+func (s *ElasticStore) SaveCommitDetail(ctx context.Context, detail *CommitDetail) error {
+	_, err := s.ES.Index().
+		Index(detailsAlias).
+		Id(commitID(detail.Repository, detail.SHA)).
+		BodyJson(detail).
+		Do(ctx)
+	return err
+}
+
+// GetCommitDetail retrieves the stored details of a commit
+func (s *ElasticStore) GetCommitDetail(ctx context.Context, fullName, sha string) (*CommitDetail, error) {
+	doc, err := s.ES.Get().
+		Index(detailsAlias).
+		Id(commitID(fullName, sha)).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrCommitNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var detail CommitDetail
+	if err := json.Unmarshal(doc.Source, &detail); err != nil {
+		return nil, err
+	}
+	return &detail, nil
+}
+
+// SetBranches chooses the branches indexed for a repository
+func (s *ElasticStore) SetBranches(ctx context.Context, fullName string, branches []string) error {
+	_, err := s.ES.Index().
+		Index(branchesAlias).
+		Id(fullName).
+		BodyJson(&repositoryBranches{Repository: fullName, Branches: branches}).
+		Refresh("wait_for").
+		Do(ctx)
+	return err
+}
+
+// GetBranches returns the branches indexed for a repository
+func (s *ElasticStore) GetBranches(ctx context.Context, fullName string) ([]string, error) {
+	doc, err := s.ES.Get().
+		Index(branchesAlias).
+		Id(fullName).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rb repositoryBranches
+	if err := json.Unmarshal(doc.Source, &rb); err != nil {
+		return nil, err
+	}
+	return rb.Branches, nil
+}
+
+// repositoryBranches is the document holding the branches of a repository
+type repositoryBranches struct {
+	Repository string   `json:"repository"`
+	Branches   []string `json:"branches"`
+}
+
+// percolatedSearch is the document of a saved search. Its query is matched
+// against commits as they are indexed.
+type percolatedSearch struct {
+	*storedSearch
+	Query map[string]interface{} `json:"query"`
+}
+
+// maxPercolatedCommits bounds the commits percolated in one request
+const maxPercolatedCommits = 500
+
+// SaveSearch creates or replaces a saved search
+func (s *ElasticStore) SaveSearch(ctx context.Context, ss *SavedSearch) error {
+	_, err := s.ES.Index().
+		Index(searchesAlias).
+		Id(ss.ID).
+		BodyJson(&percolatedSearch{storedSearch: newStoredSearch(ss), Query: commitQuery(ss.Repository, ss.Query())}).
+		Refresh("wait_for").
+		Do(ctx)
+	return err
+}
+
+// GetSearch retrieves a saved search by id
+func (s *ElasticStore) GetSearch(ctx context.Context, id string) (*SavedSearch, error) {
+	doc, err := s.ES.Get().
+		Index(searchesAlias).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrSearchNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decodeSearch(doc.Source)
+}
+
+// GetSearches lists the saved searches of a Github user
+func (s *ElasticStore) GetSearches(ctx context.Context, login string) ([]*SavedSearch, error) {
+	searchResult, err := s.ES.Search(searchesAlias).
+		Query(elastic.NewTermQuery("owner", login)).
+		Size(1000).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return savedSearches(searchResult)
+}
+
+// DeleteSearch removes a saved search
+func (s *ElasticStore) DeleteSearch(ctx context.Context, id string) error {
+	_, err := s.ES.Delete().
+		Index(searchesAlias).
+		Id(id).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrSearchNotFound
+	}
+	return err
+}
+
+// MatchSearches percolates the new commits through the saved searches of
+// their repository, up to maxPercolatedCommits commits a request. Each hit
+// names the commits it matched by their slot in the request.
+func (s *ElasticStore) MatchSearches(ctx context.Context, fullName string, commits []*IndexCommit) ([]*Alert, error) {
+	alerts := make(map[string]*Alert)
+	var ordered []*Alert
+	for start := 0; start < len(commits); start += maxPercolatedCommits {
+		batch := commits[start:min(start+maxPercolatedCommits, len(commits))]
+		docs := make([]interface{}, len(batch))
+		for i, commit := range batch {
+			docs[i] = commit
+		}
+		query := elastic.NewBoolQuery().
+			Must(elastic.NewPercolatorQuery().Field("query").Document(docs...)).
+			Filter(elastic.NewTermQuery("repository", fullName))
+		searchResult, err := s.ES.Search(searchesAlias).
+			Query(query).
+			Size(1000).
+			Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			ss, err := decodeSearch(hit.Source)
+			if err != nil {
+				return nil, err
+			}
+			alert, ok := alerts[ss.ID]
+			if !ok {
+				alert = &Alert{Search: ss}
+				alerts[ss.ID] = alert
+				ordered = append(ordered, alert)
+			}
+			slots, ok := hit.Fields.Float64s("_percolator_document_slot")
+			if !ok && len(batch) == 1 {
+				slots = []float64{0}
+			}
+			for _, slot := range slots {
+				if i := int(slot); i >= 0 && i < len(batch) {
+					alert.Commits = append(alert.Commits, batch[i])
+				}
+			}
+		}
+	}
+	return ordered, nil
+}
+
+func savedSearches(searchResult *elastic.SearchResult) ([]*SavedSearch, error) {
+	var searches []*SavedSearch
+	for _, hit := range searchResult.Hits.Hits {
+		ss, err := decodeSearch(hit.Source)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, ss)
+	}
+	return searches, nil
+}
+
+// commitQuery builds the query DSL of a commit search, as stored with a
+// saved search
+func commitQuery(fullName string, q *SearchQuery) map[string]interface{} {
+	term := func(field, value string) map[string]interface{} {
+		return map[string]interface{}{"term": map[string]interface{}{field: value}}
+	}
+	filter := []interface{}{term("repository", fullName)}
+	if q.Branch != "" {
+		filter = append(filter, term("branches", q.Branch))
+	}
+	if q.Tag != "" {
+		filter = append(filter, term("tags", q.Tag))
+	}
+	query := map[string]interface{}{"filter": filter}
+	if q.Term != "" {
+		query["must"] = []interface{}{
+			map[string]interface{}{"match": map[string]interface{}{"all": q.Term}},
+		}
+	}
+	return map[string]interface{}{"bool": query}
+}
+
+// SaveWorkspace creates or replaces a workspace
+func (s *ElasticStore) SaveWorkspace(ctx context.Context, ws *Workspace) error {
+	_, err := s.ES.Index().
+		Index(workspacesAlias).
+		Id(ws.ID).
+		BodyJson(ws).
+		Refresh("wait_for").
+		Do(ctx)
+	return err
+}
+
+// GetWorkspace retrieves a workspace by id
+func (s *ElasticStore) GetWorkspace(ctx context.Context, id string) (*Workspace, error) {
+	doc, err := s.ES.Get().
+		Index(workspacesAlias).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrWorkspaceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ws Workspace
+	if err := json.Unmarshal(doc.Source, &ws); err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+// AddWorkspaceMember adds a Github user to a workspace
+func (s *ElasticStore) AddWorkspaceMember(ctx context.Context, id, login string) error {
+	return s.updateWorkspace(ctx, id, func(ws *Workspace) bool { return ws.addMember(login) })
+}
+
+// AddWorkspaceRepository adds a repository to a workspace
+func (s *ElasticStore) AddWorkspaceRepository(ctx context.Context, id, fullName string) error {
+	return s.updateWorkspace(ctx, id, func(ws *Workspace) bool { return ws.addRepository(fullName) })
+}
+
+// updateWorkspace reads, changes and writes a workspace, only if nobody
+// wrote it in between. On a conflict the workspace is read again and the
+// change retried.
+func (s *ElasticStore) updateWorkspace(ctx context.Context, id string, change func(*Workspace) bool) error {
+	for {
+		doc, err := s.ES.Get().
+			Index(workspacesAlias).
+			Id(id).
+			Do(ctx)
+		if elastic.IsNotFound(err) {
+			return ErrWorkspaceNotFound
+		} else if err != nil {
+			return err
+		}
+		var ws Workspace
+		if err := json.Unmarshal(doc.Source, &ws); err != nil {
+			return err
+		}
+		if !change(&ws) {
+			return nil
+		}
+
+		_, err = s.ES.Index().
+			Index(workspacesAlias).
+			Id(id).
+			BodyJson(&ws).
+			IfSeqNo(*doc.SeqNo).
+			IfPrimaryTerm(*doc.PrimaryTerm).
+			Refresh("wait_for").
+			Do(ctx)
+		if !elastic.IsConflict(err) {
+			return err
+		}
+	}
+}
+
+// GetWorkspaces retrieves the workspaces a Github user is a member of
+func (s *ElasticStore) GetWorkspaces(ctx context.Context, login string) ([]*Workspace, error) {
+	searchResult, err := s.ES.Search(workspacesAlias).
+		Query(elastic.NewTermQuery("members", login)).
+		Size(1000).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var workspaces []*Workspace
+	for _, hit := range searchResult.Hits.Hits {
+		var ws Workspace
+		if err := json.Unmarshal(hit.Source, &ws); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, &ws)
+	}
+	return workspaces, nil
+}
+
+// SaveLogin records the Github login of a user as they sign in
+func (s *ElasticStore) SaveLogin(ctx context.Context, token, login string) error {
+	_, err := s.ES.Index().
+		Index(usersAlias).
+		Id(userKey(token)).
+		BodyJson(&userRecord{Key: userKey(token), Login: login, LastLogin: time.Now().UTC()}).
+		Do(ctx)
+	return err
+}
+
+// GetUsers lists every user with a repository list. Users are found by the
+// indices behind their repository lists, named after their user key.
+func (s *ElasticStore) GetUsers(ctx context.Context) ([]*UserSummary, error) {
+	stats, err := s.ES.IndexStats(indexPrefix + "-repositories-*").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*UserSummary)
+	var keys []string
+	for index := range stats.Indices {
+		key := indexUserKey(index)
+		if _, ok := users[key]; !ok {
+			users[key] = &UserSummary{Key: key, Repositories: []string{}}
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// Add logins, missing for users who have not signed in since
+	searchResult, err := s.ES.Search(usersAlias).
+		Size(10000).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		var record userRecord
+		if err := json.Unmarshal(hit.Source, &record); err != nil {
+			return nil, err
+		}
+		if user, ok := users[record.Key]; ok {
+			lastLogin := record.LastLogin
+			user.Login, user.LastLogin = record.Login, &lastLogin
+		}
+	}
+
+	// Add active repositories
+	searchResult, err = s.ES.Search(indexPrefix + "-repositories-*").
+		Query(elastic.NewTermQuery("active", true)).
+		Size(10000).
+		Do(ctx)
 	if err != nil {
+		return nil, err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		var repo Repository
+		if err := json.Unmarshal(hit.Source, &repo); err != nil {
+			return nil, err
+		}
+		if user, ok := users[indexUserKey(hit.Index)]; ok {
+			user.Repositories = append(user.Repositories, repo.FullName)
+		}
+	}
+
+	summaries := make([]*UserSummary, 0, len(keys))
+	for _, key := range keys {
+		sort.Strings(users[key].Repositories)
+		summaries = append(summaries, users[key])
+	}
+	return summaries, nil
+}
+
+// DeleteUser removes the repository list and login of a user, their saved
+// searches and their membership of workspaces
+func (s *ElasticStore) DeleteUser(ctx context.Context, key string) error {
+	alias := indexPrefix + "-repositories-" + key
+	if exists, err := s.ES.IndexExists(alias).Do(ctx); err != nil {
 		return err
-	} else if !mapping.Acknowledged {
-		return errors.New("mapping not acknowledged")
+	} else if !exists {
+		return ErrUserNotFound
 	}
 
-	return nil
+	// Look the login up before it is removed
+	var record userRecord
+	doc, err := s.ES.Get().
+		Index(usersAlias).
+		Id(key).
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(doc.Source, &record); err != nil {
+			return err
+		}
+	}
+
+	// Remove the repository list and commits indexed before sharing
+	for _, alias := range []string{alias, indexPrefix + "-commits-" + key} {
+		if exists, err := s.ES.IndexExists(alias).Do(ctx); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		indices, err := s.aliasIndices(ctx, alias)
+		if err != nil {
+			return err
+		}
+		if _, err := s.ES.DeleteIndex(indices...).Do(ctx); err != nil {
+			return err
+		}
+	}
+	if record.Login == "" {
+		return nil
+	}
+
+	// Remove the saved searches and workspace memberships of the login
+	_, err = s.ES.DeleteByQuery(searchesAlias).
+		Query(elastic.NewTermQuery("owner", record.Login)).
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	workspaces, err := s.GetWorkspaces(ctx, record.Login)
+	if err != nil {
+		return err
+	}
+	for _, ws := range workspaces {
+		ws.Members = without(ws.Members, record.Login)
+		if err := s.SaveWorkspace(ctx, ws); err != nil {
+			return err
+		}
+	}
+	_, err = s.ES.Delete().
+		Index(usersAlias).
+		Id(key).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// GetStats reports the documents and size of every index, and the commits
+// and pull requests indexed per repository
+func (s *ElasticStore) GetStats(ctx context.Context) (*StorageStats, error) {
+	res, err := s.ES.IndexStats(indexPrefix + "-*").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats := &StorageStats{}
+	for name, index := range res.Indices {
+		is := &IndexStats{Name: name}
+		if index.Primaries != nil && index.Primaries.Docs != nil {
+			is.Documents = index.Primaries.Docs.Count
+		}
+		if index.Total != nil && index.Total.Store != nil {
+			is.Bytes = index.Total.Store.SizeInBytes
+		}
+		stats.Indices = append(stats.Indices, is)
+	}
+	sort.Slice(stats.Indices, func(i, j int) bool { return stats.Indices[i].Name < stats.Indices[j].Name })
+
+	// Count documents per repository
+	repos := make(map[string]*RepositoryStats)
+	count := func(alias string, query elastic.Query, add func(*RepositoryStats, int64)) error {
+		searchResult, err := s.ES.Search(alias).
+			Query(query).
+			Size(0).
+			Aggregation("repositories", elastic.NewTermsAggregation().Field("repository").Size(10000)).
+			Do(ctx)
+		if err != nil {
+			return err
+		}
+		buckets, ok := searchResult.Aggregations.Terms("repositories")
+		if !ok {
+			return nil
+		}
+		for _, bucket := range buckets.Buckets {
+			name := fmt.Sprint(bucket.Key)
+			if repos[name] == nil {
+				repos[name] = &RepositoryStats{Repository: name}
+			}
+			add(repos[name], bucket.DocCount)
+		}
+		return nil
+	}
+	err = count(commitsAlias, elastic.NewMatchAllQuery(), func(rs *RepositoryStats, n int64) { rs.Commits = n })
+	if err != nil {
+		return nil, err
+	}
+	err = count(pullsAlias, elastic.NewTermQuery("type", DocPullRequest), func(rs *RepositoryStats, n int64) { rs.PullRequests = n })
+	if err != nil {
+		return nil, err
+	}
+	stats.Repositories = repositoryStats(repos)
+	return stats, nil
+}
+
+// AppendAudit records an event in the audit log
+func (s *ElasticStore) AppendAudit(ctx context.Context, event *AuditEvent) error {
+	_, err := s.ES.Index().
+		Index(auditAlias).
+		BodyJson(event).
+		Do(ctx)
+	return err
+}
+
+// GetAuditEvents lists the latest events of the audit log matching a
+// query, newest first
+func (s *ElasticStore) GetAuditEvents(ctx context.Context, q *AuditQuery) ([]*AuditEvent, error) {
+	query := elastic.NewBoolQuery()
+	for field, value := range map[string]string{"login": q.Login, "action": q.Action, "target": q.Target} {
+		if value != "" {
+			query = query.Filter(elastic.NewTermQuery(field, value))
+		}
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		times := elastic.NewRangeQuery("time")
+		if !q.Since.IsZero() {
+			times = times.Gte(q.Since)
+		}
+		if !q.Until.IsZero() {
+			times = times.Lt(q.Until)
+		}
+		query = query.Filter(times)
+	}
+
+	searchResult, err := s.ES.Search(auditAlias).
+		Query(query).
+		Sort("time", false).
+		Size(q.Limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*AuditEvent{}
+	for _, hit := range searchResult.Hits.Hits {
+		var event AuditEvent
+		if err := json.Unmarshal(hit.Source, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+// indexUserKey parses the user key out of the name of a repository list
+// index
+func indexUserKey(index string) string {
+	key := strings.TrimPrefix(index, indexPrefix+"-repositories-")
+	key, _, _ = strings.Cut(key, "-")
+	return key
+}
+
+// repositoriesAlias is the alias of a user's repository list
+func repositoriesAlias(token string) string {
+	return indexPrefix + "-repositories-" + userKey(token)
+}
+
+// legacyCommitsAlias is the alias of a user's commits before commits were
+// shared between users
+func legacyCommitsAlias(token string) string {
+	return indexPrefix + "-commits-" + userKey(token)
+}
+
+// commitID identifies a commit of a repository
+func commitID(fullName, sha string) string {
+	return fullName + "@" + sha
+}
+
+// versionedIndex names the concrete index behind an alias
+func versionedIndex(alias string, version int) string {
+	return fmt.Sprintf("%s-v%d", alias, version)
 }
 
-func indexSettingsAndMapping() map[string]interface{} {
-	// Build settings for n-gram tokenizer
-	j := make(map[string]interface{})
-	settings := make(map[string]interface{})
-	mappings := make(map[string]interface{})
-	// settings["number_of_shards"] = 1
-
-	analysis := make(map[string]interface{})
-	filter := make(map[string]interface{})
-	ngramFilter := make(map[string]interface{})
-	ngramFilter["type"] = "ngram"
-	ngramFilter["min_gram"] = 2
-	ngramFilter["max_gram"] = 20
-
-	analyzer := make(map[string]interface{})
-	ngramAnalyzer := make(map[string]interface{})
-	ngramAnalyzer["type"] = "custom"
-	ngramAnalyzer["tokenizer"] = "standard"
-	ngramAnalyzer["filter"] = []string{"lowercase", "ngram_filter"}
-
-	analyzer["ngram_analyzer"] = ngramAnalyzer
-	filter["ngram_filter"] = ngramFilter
-	analysis["filter"] = filter
-	analysis["analyzer"] = analyzer
-
-	settings["analysis"] = analysis
-
-	typeName := make(map[string]interface{})
-	all := make(map[string]interface{})
-	all["type"] = "string"
-	all["analyzer"] = "ngram_analyzer"
-	all["search_analyzer"] = "standard"
-
-	properties := make(map[string]interface{})
-	commitMessage := make(map[string]interface{})
-	commitMessage["type"] = "string"
-	commitMessage["include_in_all"] = "true"
-	commitMessage["analyzer"] = "ngram_analyzer"
-	commitMessage["search_analyzer"] = "standard"
-
-	properties["commit_message"] = commitMessage
-	typeName["properties"] = properties
-	typeName["_all"] = all
-
-	mappings["_default_"] = typeName
-
-	j["mappings"] = mappings
-	j["settings"] = settings
-
-	return j
+// userKey derives an index name component from a token, so tokens never
+// appear in index names
+func userKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:10])
 }